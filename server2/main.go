@@ -3,41 +3,117 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/gchange/somersault/somersault"
 
 	_ "github.com/gchange/somersault/somersault/direct"
 	_ "github.com/gchange/somersault/somersault/echo"
+	_ "github.com/gchange/somersault/somersault/forward"
+	_ "github.com/gchange/somersault/somersault/httpproxy"
+	_ "github.com/gchange/somersault/somersault/mixed"
+	_ "github.com/gchange/somersault/somersault/ratelimit"
+	_ "github.com/gchange/somersault/somersault/redirect"
+	_ "github.com/gchange/somersault/somersault/reverse"
+	_ "github.com/gchange/somersault/somersault/sni"
+	_ "github.com/gchange/somersault/somersault/socks4"
 	_ "github.com/gchange/somersault/somersault/socks5"
+	_ "github.com/gchange/somersault/somersault/tproxy"
 )
 
 func main() {
+	fileName := flag.String("config", "config.json", "the config, json, yaml or toml")
+	format := flag.String("format", "", "the format of the config, by its extension when empty")
+	example := flag.Bool("example", false, "print every pipeline stage with its fields in -format, yaml when empty")
+	uris := flag.Bool("uris", false, "print the config with listeners and stages written as URIs where they can")
 	flag.Parse()
-	fileName := flag.String("config", "config.json", "the json config")
-	buf, err := ioutil.ReadFile(*fileName)
-	if err != nil {
-		log.Fatal(err)
+	if *example {
+		f := *format
+		if f == "" {
+			f = somersault.FormatYAML
+		}
+		buf, err := somersault.Example(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(buf)
+		return
 	}
-
-	var config somersault.Config
-	err = json.Unmarshal(buf, &config)
+	config, err := somersault.LoadConfig(*fileName, *format)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *uris {
+		m, err := config.Shorthand()
+		if err != nil {
+			log.Fatal(err)
+		}
+		buf, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(buf, '\n'))
+		return
+	}
 
 	logger := log.New(os.Stdout, "somersault", log.Lshortfile|log.LstdFlags)
 	srv, err := config.New(logger)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer srv.Close()
+	srv.SetLoader(func() (*somersault.Config, error) {
+		return somersault.LoadConfig(*fileName, *format)
+	})
+	err = notify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()))
+	if err != nil {
+		logger.Println("notify", err)
+	}
+	watchdog(logger)
 
+	upgraded := false
 	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
-	<-sc
+	signal.Notify(sc, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, upgradeSignals...)...)
+wait:
+	for sig := range sc {
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM:
+			break wait
+		case syscall.SIGHUP:
+			notify("RELOADING=1")
+			err := srv.Reload()
+			if err != nil {
+				logger.Println("reload", err)
+			} else {
+				logger.Println("config reloaded")
+			}
+			notify("READY=1")
+		default:
+			// the new process serves, drain and leave
+			err := srv.Upgrade()
+			if err == nil {
+				upgraded = true
+				break wait
+			}
+			logger.Println("upgrade", err)
+		}
+	}
+	logger.Println("shutting down, signal again to exit now")
+	if !upgraded {
+		notify("STOPPING=1")
+	}
+	go func() {
+		for sig := range sc {
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				os.Exit(1)
+			}
+		}
+	}()
+	err = srv.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
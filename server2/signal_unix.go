@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals hand the listeners over to a new process.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
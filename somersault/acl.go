@@ -0,0 +1,233 @@
+package somersault
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const (
+	limitACL = "acl"
+
+	aclCheckInterval = time.Second
+)
+
+var (
+	Forbidden      = errors.New("source address not allowed")
+	UntrustedProxy = errors.New("proxy protocol header from an untrusted peer")
+)
+
+// cidrList is a set of networks given inline and from a file, one CIDR or
+// address per line with # comments. The file is read again when its
+// modification time changes.
+type cidrList struct {
+	inline []*net.IPNet
+	file   string
+
+	lock    sync.Mutex
+	nets    []*net.IPNet
+	modTime time.Time
+	checked time.Time
+}
+
+// parseCIDRs parses a list of networks or addresses of the option name.
+func parseCIDRs(name string, list []string) ([]*net.IPNet, error) {
+	if list == nil {
+		return nil, nil
+	}
+	nets := make([]*net.IPNet, 0, len(list))
+	for i, s := range list {
+		n, err := pipeline.ParseCIDR(s)
+		if err != nil {
+			return nil, pipeline.FieldError(fmt.Sprintf("%s[%d]", name, i), err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newCIDRList(name string, list []string, file string) (*cidrList, error) {
+	inline, err := parseCIDRs(name, list)
+	if err != nil {
+		return nil, err
+	}
+	l := &cidrList{inline: inline, file: file}
+	if l.file != "" {
+		err := l.load()
+		if err != nil {
+			return nil, pipeline.FieldError(name+"_file", err)
+		}
+	}
+	return l, nil
+}
+
+func (l *cidrList) empty() bool {
+	return len(l.inline) == 0 && l.file == ""
+}
+
+// load reads the file, with the lock held or before the list is shared.
+func (l *cidrList) load() error {
+	f, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		s := scanner.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := pipeline.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", l.file, line, err)
+		}
+		nets = append(nets, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.nets = nets
+	l.modTime = info.ModTime()
+	return nil
+}
+
+// refresh reloads the file when it changed, keeping the old entries if it
+// can not be read.
+func (l *cidrList) refresh() error {
+	now := time.Now()
+	if now.Sub(l.checked) < aclCheckInterval {
+		return nil
+	}
+	l.checked = now
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(l.modTime) {
+		return nil
+	}
+	return l.load()
+}
+
+func (l *cidrList) contains(ip net.IP, logf func(string, ...interface{})) bool {
+	for _, n := range l.inline {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if l.file == "" {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.refresh(); err != nil {
+		logf("reload %s: %s\n", l.file, err)
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acl filters the clients of a listener by source address:
+//
+//	allow, allow_file  only these networks may connect
+//	deny, deny_file    these networks may not, even when allowed
+type acl struct {
+	denied uint64
+	allow  *cidrList
+	deny   *cidrList
+	logf   func(string, ...interface{})
+}
+
+func newACL(l *Listener, logf func(string, ...interface{})) (*acl, error) {
+	allow, err := newCIDRList("allow", l.Allow, l.AllowFile)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := newCIDRList("deny", l.Deny, l.DenyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &acl{allow: allow, deny: deny, logf: logf}, nil
+}
+
+func (a *acl) check(addr net.Addr) error {
+	if a.allow.empty() && a.deny.empty() {
+		return nil
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		// unix sockets and tunnels have no address to filter on
+		return nil
+	}
+	if a.deny.contains(ip, a.logf) || (!a.allow.empty() && !a.allow.contains(ip, a.logf)) {
+		atomic.AddUint64(&a.denied, 1)
+		return Forbidden
+	}
+	return nil
+}
+
+// addrIP is the ip of addr, nil for addresses without one like those of
+// unix sockets.
+func addrIP(addr net.Addr) net.IP {
+	host := sourceIP(addr)
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// trustProxy tells whether the PROXY header of the peer at addr is
+// believed, proxy_trusted and proxy_trusted_file listing the load
+// balancers that may send one. Peers of unix sockets have no address,
+// the mode of the socket decides who they are.
+func trustProxy(trusted *cidrList, addr net.Addr, logf func(string, ...interface{})) bool {
+	ip := addrIP(addr)
+	return ip == nil || trusted.contains(ip, logf)
+}
+
+// newDestinationPolicy reads the destination policy of a listener:
+//
+//	destination_allow     networks clients may reach, internal ones included
+//	destination_deny      networks clients may not reach
+//	destination_internal  true lets clients reach every internal network
+func newDestinationPolicy(l *Listener) (*pipeline.DestinationPolicy, error) {
+	allow, err := parseCIDRs("destination_allow", l.DestinationAllow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs("destination_deny", l.DestinationDeny)
+	if err != nil {
+		return nil, err
+	}
+	internal := l.DestinationInternal
+	if allow == nil && deny == nil && !internal {
+		return nil, nil
+	}
+	return &pipeline.DestinationPolicy{
+		Allow:         allow,
+		Deny:          deny,
+		AllowInternal: internal,
+	}, nil
+}
@@ -0,0 +1,44 @@
+package somersault
+
+import (
+	"net"
+	"testing"
+
+	_ "github.com/gchange/somersault/somersault/echo"
+)
+
+func TestTrustProxy(t *testing.T) {
+	trusted, err := newCIDRList("proxy_trusted", []string{"10.0.0.0/8", "2001:db8::1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logf := func(string, ...interface{}) {}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		if got := trustProxy(trusted, tt.addr, logf); got != tt.want {
+			t.Errorf("trustProxy(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestProxyTrustedRequired(t *testing.T) {
+	l := &Listener{Address: "127.0.0.1", Port: 1080}
+	l.Pipeline = []interface{}{map[string]interface{}{"protocol": "echo"}}
+	l.ProxyProtocol = true
+	if _, err := l.parse(); err == nil {
+		t.Fatal("proxy_protocol without proxy_trusted accepted")
+	}
+	l.ProxyTrusted = []string{"10.0.0.1"}
+	if _, err := l.parse(); err != nil {
+		t.Fatal(err)
+	}
+}
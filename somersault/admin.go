@@ -0,0 +1,202 @@
+package somersault
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// redacted stands for a secret in the config the admin API shows.
+const redacted = "xxxxx"
+
+// AdminConfig serves an HTTP API on Address,
+//
+//	GET /stats           connection counters of the listeners
+//	GET /quota[/<user>]  traffic of the users
+//	POST /reload         read the config again
+//	GET /config          the running config, as URIs where it can, secrets hidden
+//
+// Requests carry Token as "Authorization: Bearer <token>". Only an API on a
+// loopback address may go without one.
+type AdminConfig struct {
+	Address string `json:"address"`
+	Token   string `json:"token,omitempty"`
+}
+
+func (c *AdminConfig) validate() error {
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return pipeline.FieldError("address", err)
+	}
+	if c.Token == "" && !isLoopback(host) {
+		return pipeline.FieldError("token", errors.New("required unless the address is a loopback one"))
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize lets the requests carrying the token through to h.
+func (c *AdminConfig) authorize(h http.Handler) http.Handler {
+	if c.Token == "" {
+		return h
+	}
+	want := []byte("Bearer " + c.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Somerasult) serveAdmin(c *AdminConfig) error {
+	var l net.Listener
+	var err error
+	if f := takeInherited(adminKey(c.Address)); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = net.Listen("tcp", c.Address)
+	}
+	if err != nil {
+		return err
+	}
+	s.adminListener = l
+	s.adminAddress = c.Address
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Stats())
+	})
+	mux.HandleFunc("/quota", s.serveQuota)
+	mux.HandleFunc("/quota/", s.serveQuota)
+	mux.HandleFunc("/reload", s.serveReload)
+	mux.HandleFunc("/config", s.serveConfig)
+	s.admin = &http.Server{Handler: c.authorize(mux)}
+	go func() {
+		err := s.admin.Serve(l)
+		if err != http.ErrServerClosed {
+			s.logger.Println("admin", err)
+		}
+	}()
+	s.logger.Printf("admin api on %s\n", l.Addr())
+	return nil
+}
+
+func adminKey(address string) string {
+	return "admin " + address
+}
+
+func (s *Somerasult) serveQuota(w http.ResponseWriter, r *http.Request) {
+	if s.quota == nil {
+		http.Error(w, "quota is not enabled", http.StatusNotFound)
+		return
+	}
+	user := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/quota"), "/")
+	writeJSON(w, s.Quota(user))
+}
+
+func (s *Somerasult) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.Reload()
+	if err == NoLoader {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		s.logger.Println("reload", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("config reloaded")
+	writeJSON(w, s.Stats())
+}
+
+func (s *Somerasult) serveConfig(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	c := s.Config
+	s.lock.Unlock()
+	m, err := c.Shorthand()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, redact(m))
+}
+
+// isSecret tells whether the value of key is a secret, like password,
+// token or proxy_password.
+func isSecret(key string) bool {
+	for _, name := range []string{"password", "token", "secret"} {
+		if key == name || strings.HasSuffix(key, "_"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact hides the passwords, tokens and user secrets of a config, the
+// passwords of URIs included.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if _, ok := item.(string); ok && isSecret(key) {
+				v[key] = redacted
+				continue
+			}
+			if users, ok := item.(map[string]interface{}); ok && key == "users" {
+				for name := range users {
+					users[name] = redacted
+				}
+				continue
+			}
+			v[key] = redact(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redact(item)
+		}
+	case string:
+		if !strings.Contains(v, "://") {
+			return v
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			return v
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		query := u.Query()
+		for key := range query {
+			if isSecret(key) || key == "users" {
+				query[key] = []string{redacted}
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return v
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,103 @@
+package somersault
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAdminValidate(t *testing.T) {
+	tests := []struct {
+		admin AdminConfig
+		ok    bool
+	}{
+		{AdminConfig{Address: "127.0.0.1:9090"}, true},
+		{AdminConfig{Address: "[::1]:9090"}, true},
+		{AdminConfig{Address: "localhost:9090"}, true},
+		{AdminConfig{Address: ":9090"}, false},
+		{AdminConfig{Address: "0.0.0.0:9090"}, false},
+		{AdminConfig{Address: "192.0.2.1:9090"}, false},
+		{AdminConfig{Address: "0.0.0.0:9090", Token: "t"}, true},
+		{AdminConfig{Address: "9090"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.admin.validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: %v", tt.admin, err)
+		}
+	}
+}
+
+func TestAdminAuthorize(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	c := &AdminConfig{Address: "0.0.0.0:9090", Token: "s3cret"}
+	tests := []struct {
+		header string
+		code   int
+	}{
+		{"Bearer s3cret", http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"Bearer s3cre", http.StatusUnauthorized},
+		{"Bearer s3cret2", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/config", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		c.authorize(ok).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%q: status %d, want %d", tt.header, w.Code, tt.code)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	config := map[string]interface{}{
+		"admin": map[string]interface{}{"address": "0.0.0.0:9090", "token": "t"},
+		"config": []interface{}{
+			"socks5://alice:pw@:1080?allow=10.0.0.0%2F8",
+			"tunnel://:7000?allow_bind=true&token=t0k",
+			map[string]interface{}{
+				"address": "127.0.0.1",
+				"pipeline": []interface{}{
+					map[string]interface{}{
+						"protocol": "socks5",
+						"config": map[string]interface{}{
+							"users":          map[string]interface{}{"alice": "pw", "bob": "pw2"},
+							"password":       "up",
+							"proxy_password": "pp",
+							"port":           1080,
+						},
+					},
+				},
+			},
+		},
+	}
+	want := map[string]interface{}{
+		"admin": map[string]interface{}{"address": "0.0.0.0:9090", "token": redacted},
+		"config": []interface{}{
+			"socks5://alice:xxxxx@:1080?allow=10.0.0.0%2F8",
+			"tunnel://:7000?allow_bind=true&token=xxxxx",
+			map[string]interface{}{
+				"address": "127.0.0.1",
+				"pipeline": []interface{}{
+					map[string]interface{}{
+						"protocol": "socks5",
+						"config": map[string]interface{}{
+							"users":          map[string]interface{}{"alice": redacted, "bob": redacted},
+							"password":       redacted,
+							"proxy_password": redacted,
+							"port":           1080,
+						},
+					},
+				},
+			},
+		},
+	}
+	if got := redact(config); !reflect.DeepEqual(got, want) {
+		t.Errorf("redact:\n%v\nwant\n%v", got, want)
+	}
+}
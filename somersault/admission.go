@@ -0,0 +1,254 @@
+package somersault
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	limitListener = "listener"
+	limitSource   = "source"
+	limitUser     = "user"
+	limitRate     = "rate"
+)
+
+// LimitError refuses a connection that went over one of the limits of its
+// listener.
+type LimitError struct {
+	Limit string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s connection limit reached", e.Limit)
+}
+
+// admission enforces the connection limits of a listener:
+//
+//	max_connections          concurrent connections
+//	max_connections_per_ip   concurrent connections of one client ip
+//	max_connections_per_user concurrent connections of one user
+//	connection_rate          new connections per second, with
+//	connection_burst         allowed above the rate at once
+//	on_limit                 "reject" or "queue" for up to queue_timeout
+type admission struct {
+	maxConns     int
+	maxPerIP     int
+	maxPerUser   int
+	rate         float64
+	burst        float64
+	queue        bool
+	queueTimeout time.Duration
+
+	lock    sync.Mutex
+	active  int
+	perIP   map[string]int
+	perUser map[string]int
+	changed chan struct{}
+	tokens  float64
+	last    time.Time
+
+	accepted uint64
+	rejected map[string]*uint64
+}
+
+func newAdmission(l *Listener) *admission {
+	a := &admission{
+		perIP:   make(map[string]int),
+		perUser: make(map[string]int),
+		changed: make(chan struct{}),
+		last:    time.Now(),
+		rejected: map[string]*uint64{
+			limitListener: new(uint64),
+			limitSource:   new(uint64),
+			limitUser:     new(uint64),
+			limitRate:     new(uint64),
+		},
+	}
+	a.maxConns = l.MaxConnections
+	a.maxPerIP = l.MaxConnectionsPerIP
+	a.maxPerUser = l.MaxConnectionsPerUser
+	burst := l.ConnectionBurst
+	if burst <= 0 {
+		burst = l.ConnectionRate
+	}
+	a.rate = float64(l.ConnectionRate)
+	a.burst = float64(burst)
+	a.tokens = a.burst
+
+	if l.OnLimit == "queue" {
+		a.queue = true
+		a.queueTimeout = 10 * time.Second
+		if l.QueueTimeout != nil {
+			a.queueTimeout = time.Duration(*l.QueueTimeout)
+		}
+	}
+	return a
+}
+
+// sameLimits tells whether b enforces the limits of a.
+func (a *admission) sameLimits(b *admission) bool {
+	return a.maxConns == b.maxConns &&
+		a.maxPerIP == b.maxPerIP &&
+		a.maxPerUser == b.maxPerUser &&
+		a.rate == b.rate &&
+		a.burst == b.burst &&
+		a.queue == b.queue &&
+		a.queueTimeout == b.queueTimeout
+}
+
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// wait blocks with the lock held until ok is true, at most until deadline
+// and only when queueing.
+func (a *admission) wait(deadline time.Time, ok func() bool) bool {
+	for !ok() {
+		remain := time.Until(deadline)
+		if !a.queue || remain <= 0 {
+			return false
+		}
+		changed := a.changed
+		a.lock.Unlock()
+		timer := time.NewTimer(remain)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		a.lock.Lock()
+	}
+	return true
+}
+
+func (a *admission) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *admission) reject(limit string) error {
+	atomic.AddUint64(a.rejected[limit], 1)
+	return &LimitError{limit}
+}
+
+// takeRate spends a token of the new connection rate.
+func (a *admission) takeRate(deadline time.Time) bool {
+	if a.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	a.tokens += now.Sub(a.last).Seconds() * a.rate
+	if a.tokens > a.burst {
+		a.tokens = a.burst
+	}
+	a.last = now
+	if a.tokens >= 1 {
+		a.tokens--
+		return true
+	}
+	delay := time.Duration((1 - a.tokens) / a.rate * float64(time.Second))
+	if !a.queue || now.Add(delay).After(deadline) {
+		return false
+	}
+	// reserve the token and sleep off the debt
+	a.tokens--
+	a.lock.Unlock()
+	time.Sleep(delay)
+	a.lock.Lock()
+	return true
+}
+
+// admit takes a slot for a new connection from ip.
+func (a *admission) admit(ip string) error {
+	deadline := time.Now().Add(a.queueTimeout)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.takeRate(deadline) {
+		return a.reject(limitRate)
+	}
+	listenerFree := func() bool { return a.maxConns <= 0 || a.active < a.maxConns }
+	sourceFree := func() bool { return a.maxPerIP <= 0 || a.perIP[ip] < a.maxPerIP }
+	if !a.wait(deadline, func() bool { return listenerFree() && sourceFree() }) {
+		if !listenerFree() {
+			return a.reject(limitListener)
+		}
+		return a.reject(limitSource)
+	}
+	a.active++
+	a.perIP[ip]++
+	atomic.AddUint64(&a.accepted, 1)
+	return nil
+}
+
+func (a *admission) release(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.active--
+	a.perIP[ip]--
+	if a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+	a.notify()
+}
+
+// admitUser takes a slot for user once a stage authenticated it.
+func (a *admission) admitUser(user string) error {
+	if a.maxPerUser <= 0 || user == "" {
+		return nil
+	}
+	deadline := time.Now().Add(a.queueTimeout)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.wait(deadline, func() bool { return a.perUser[user] < a.maxPerUser }) {
+		return a.reject(limitUser)
+	}
+	a.perUser[user]++
+	return nil
+}
+
+func (a *admission) releaseUser(user string) {
+	if a.maxPerUser <= 0 || user == "" {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.perUser[user]--
+	if a.perUser[user] <= 0 {
+		delete(a.perUser, user)
+	}
+	a.notify()
+}
+
+// ListenerStats are the admission counters of a listener.
+type ListenerStats struct {
+	Address  string            `json:"address"`
+	Active   int               `json:"active"`
+	Accepted uint64            `json:"accepted"`
+	Rejected map[string]uint64 `json:"rejected"`
+}
+
+func (a *admission) stats(address string) ListenerStats {
+	a.lock.Lock()
+	active := a.active
+	a.lock.Unlock()
+	st := ListenerStats{
+		Address:  address,
+		Active:   active,
+		Accepted: atomic.LoadUint64(&a.accepted),
+		Rejected: make(map[string]uint64, len(a.rejected)),
+	}
+	for limit, n := range a.rejected {
+		st.Rejected[limit] = atomic.LoadUint64(n)
+	}
+	return st
+}
@@ -0,0 +1,284 @@
+package somersault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// Listener is an entry of Config, a socket and the chain serving the
+// connections it accepts.
+type Listener struct {
+	Network string `json:"network,omitempty"`
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+	// Name takes the socket systemd passed with that FileDescriptorName.
+	Name        string `json:"name,omitempty"`
+	Transparent bool   `json:"transparent,omitempty"`
+	// Mode, Owner and Group set the permissions of a unix socket file.
+	Mode  string `json:"mode,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	RouteOptions
+
+	// Options of a network served by a listener creator, like the tunnel
+	// of a reverse listener, are the members without a field.
+	Options map[string]interface{} `json:"-" somersault:"-"`
+
+	// path locates the entry in the config for errors, see entries
+	path string
+}
+
+// RouteOptions are the listener options a reload applies to the running
+// listener, changing any other one restarts it.
+type RouteOptions struct {
+	Pipeline      []interface{} `json:"pipeline"`
+	ProxyProtocol bool          `json:"proxy_protocol,omitempty"`
+	// ProxyTrusted are the peers a PROXY header is read from, the others
+	// are refused, see trustProxy
+	ProxyTrusted     []string `json:"proxy_trusted,omitempty"`
+	ProxyTrustedFile string   `json:"proxy_trusted_file,omitempty"`
+
+	// see acl and newDestinationPolicy
+	Allow               []string `json:"allow,omitempty"`
+	AllowFile           string   `json:"allow_file,omitempty"`
+	Deny                []string `json:"deny,omitempty"`
+	DenyFile            string   `json:"deny_file,omitempty"`
+	DestinationAllow    []string `json:"destination_allow,omitempty"`
+	DestinationDeny     []string `json:"destination_deny,omitempty"`
+	DestinationInternal bool     `json:"destination_internal,omitempty"`
+
+	// see newTimeouts
+	HandshakeTimeout    *pipeline.Duration `json:"handshake_timeout,omitempty"`
+	IdleTimeout         pipeline.Duration  `json:"idle_timeout,omitempty"`
+	UploadIdleTimeout   pipeline.Duration  `json:"upload_idle_timeout,omitempty"`
+	DownloadIdleTimeout pipeline.Duration  `json:"download_idle_timeout,omitempty"`
+	DialTimeout         *pipeline.Duration `json:"dial_timeout,omitempty"`
+	MaxLifetime         pipeline.Duration  `json:"max_lifetime,omitempty"`
+
+	BufferSize pipeline.Size `json:"buffer_size,omitempty"`
+
+	// see admission
+	MaxConnections        int                `json:"max_connections,omitempty"`
+	MaxConnectionsPerIP   int                `json:"max_connections_per_ip,omitempty"`
+	MaxConnectionsPerUser int                `json:"max_connections_per_user,omitempty"`
+	ConnectionRate        int                `json:"connection_rate,omitempty"`
+	ConnectionBurst       int                `json:"connection_burst,omitempty"`
+	OnLimit               string             `json:"on_limit,omitempty"`
+	QueueTimeout          *pipeline.Duration `json:"queue_timeout,omitempty"`
+}
+
+func (l *Listener) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	return l.DecodeConfig(v)
+}
+
+// DecodeConfig decodes l from a URI or an object, the members without a
+// field go to Options.
+func (l *Listener) DecodeConfig(val interface{}) error {
+	if uri, ok := val.(string); ok {
+		var err error
+		val, err = listenerObject(uri)
+		if err != nil {
+			return err
+		}
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return errors.New("must be an object")
+	}
+	type plain Listener
+	known := make(map[string]bool)
+	for _, f := range pipeline.Describe((*plain)(l)) {
+		known[f.Key] = true
+	}
+	fields := make(map[string]interface{}, len(m))
+	options := make(map[string]interface{})
+	for key, v := range m {
+		if known[key] {
+			fields[key] = v
+		} else {
+			options[key] = v
+		}
+	}
+	err := pipeline.Decode((*plain)(l), fields)
+	if err != nil {
+		return err
+	}
+	if len(options) != 0 {
+		l.Options = options
+	}
+	return nil
+}
+
+func (l Listener) MarshalJSON() ([]byte, error) {
+	type plain Listener
+	buf, err := json.Marshal((*plain)(&l))
+	if err != nil || len(l.Options) == 0 {
+		return buf, err
+	}
+	m := make(map[string]interface{})
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range l.Options {
+		m[k] = v
+	}
+	return json.Marshal(m)
+}
+
+// socket returns the network of l and the address it listens on.
+func (l *Listener) socket() (string, string) {
+	network := l.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if isUnixNetwork(network) {
+		return network, l.Address
+	}
+	return network, net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+// key identifies the socket of l, listeners of a network served by a
+// listener creator also by their options, like the tunnels of reverse
+// listeners sharing a server.
+func (l *Listener) key() (string, error) {
+	network, addr := l.socket()
+	key := network + " " + addr
+	if len(l.Options) == 0 {
+		return key, nil
+	}
+	options, err := json.Marshal(l.Options)
+	return key + " " + string(options), err
+}
+
+// parse checks the options of l and builds its chain.
+func (l *Listener) parse() ([]pipeline.Config, error) {
+	network, _ := l.socket()
+	if l.Address == "" {
+		return nil, pipeline.FieldError("address", pipeline.Required)
+	}
+	if !isUnixNetwork(network) && (l.Port <= 0 || l.Port > 65535) {
+		return nil, pipeline.FieldError("port", errors.New("must be 1-65535"))
+	}
+	if l.Mode != "" {
+		if _, err := strconv.ParseUint(l.Mode, 8, 32); err != nil {
+			return nil, pipeline.FieldError("mode", fmt.Errorf("invalid mode %s", l.Mode))
+		}
+	}
+	if len(l.Options) != 0 {
+		_, err := pipeline.GetListenerCreator(network, l.Options)
+		if err == pipeline.ListenerNotFound {
+			keys := make([]string, 0, len(l.Options))
+			for key := range l.Options {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return nil, pipeline.FieldError(keys[0], pipeline.UnknownField)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"max_connections", l.MaxConnections},
+		{"max_connections_per_ip", l.MaxConnectionsPerIP},
+		{"max_connections_per_user", l.MaxConnectionsPerUser},
+		{"connection_rate", l.ConnectionRate},
+		{"connection_burst", l.ConnectionBurst},
+		{"buffer_size", int(l.BufferSize)},
+	} {
+		if n.value < 0 {
+			return nil, pipeline.FieldError(n.name, errors.New("must not be negative"))
+		}
+	}
+	for _, list := range []struct {
+		name  string
+		value []string
+	}{
+		{"allow", l.Allow},
+		{"deny", l.Deny},
+		{"proxy_trusted", l.ProxyTrusted},
+		{"destination_allow", l.DestinationAllow},
+		{"destination_deny", l.DestinationDeny},
+	} {
+		if _, err := parseCIDRs(list.name, list.value); err != nil {
+			return nil, err
+		}
+	}
+	if l.ProxyProtocol && len(l.ProxyTrusted) == 0 && l.ProxyTrustedFile == "" {
+		return nil, pipeline.FieldError("proxy_trusted", errors.New("required with proxy_protocol"))
+	}
+	switch l.OnLimit {
+	case "", "reject", "queue":
+	default:
+		return nil, pipeline.FieldError("on_limit", errors.New("must be reject or queue"))
+	}
+	chain, err := pipeline.ParseChain(l.Pipeline)
+	if err != nil {
+		return nil, pipeline.FieldError("pipeline", err)
+	}
+	return chain, nil
+}
+
+// ParseConfig decodes and validates a json config. Members the config
+// does not know are refused, errors locate the offending value like
+// config[2].pipeline[0].config.port.
+func ParseConfig(data []byte) (*Config, error) {
+	return ParseConfigFormat(data, FormatJSON)
+}
+
+// position returns the line and column of offset in data, from 1.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// Validate checks every listener of c, and the admin API, without opening
+// anything.
+func (c *Config) Validate() error {
+	if c.Admin != nil {
+		if err := c.Admin.validate(); err != nil {
+			return pipeline.FieldError("admin", err)
+		}
+	}
+	listeners, err := c.entries()
+	if err != nil {
+		return err
+	}
+	defined := make(map[string]bool)
+	for _, l := range listeners {
+		_, err := l.parse()
+		if err != nil {
+			return pipeline.FieldError(l.path, err)
+		}
+		key, err := l.key()
+		if err != nil {
+			return pipeline.FieldError(l.path, err)
+		}
+		if defined[key] {
+			return pipeline.FieldError(l.path, errors.New("listener defined twice"))
+		}
+		defined[key] = true
+	}
+	return nil
+}
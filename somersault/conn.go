@@ -0,0 +1,59 @@
+package somersault
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// trackedConn runs the functions atClose registers once the connection is
+// closed, whichever stage closes it, the last registered first.
+type trackedConn struct {
+	net.Conn
+	lock    sync.Mutex
+	closed  bool
+	onClose []func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.lock.Lock()
+	onClose := c.onClose
+	c.onClose = nil
+	c.closed = true
+	c.lock.Unlock()
+	for i := len(onClose) - 1; i >= 0; i-- {
+		onClose[i]()
+	}
+	return err
+}
+
+// atClose runs f when c is closed, right away when it already is.
+func (c *trackedConn) atClose(f func()) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		f()
+		return
+	}
+	c.onClose = append(c.onClose, f)
+	c.lock.Unlock()
+}
+
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return pipeline.CloseWrite(c.Conn)
+}
+
+func (c *trackedConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.New("not a socket")
+}
@@ -5,14 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/gchange/somersault/somersault/pipeline"
+	"github.com/gchange/somersault/somersault/proxyproto"
 )
 
 type Config struct {
 	Network string `somersault:"network"`
 	Address string `somersault:"address"`
 	Port    int    `somersault:"port"`
+	// ProxyProtocol is the PROXY protocol version sent to the remote
+	// before any data, 0 disables it.
+	ProxyProtocol int `somersault:"proxy_protocol,enum=0|1|2"`
 }
 
 type TCP struct {
@@ -22,23 +27,63 @@ type TCP struct {
 
 func (c *Config) DeepCopy() pipeline.Config {
 	return &Config{
-		Network: c.Network,
-		Address: c.Address,
-		Port:    c.Port,
+		Network:       c.Network,
+		Address:       c.Address,
+		Port:          c.Port,
+		ProxyProtocol: c.ProxyProtocol,
 	}
 }
 
+func (c *Config) Validate() error {
+	if c.Network == "" {
+		return pipeline.FieldError("network", pipeline.Required)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return pipeline.FieldError("port", errors.New("must be 0-65535"))
+	}
+	return nil
+}
+
 func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
-	if c.Network == "" || c.Port == 0 {
+	if c.Network == "" {
 		fmt.Println(c)
 		return nil, errors.New("remote address format error")
 	}
-	addr := fmt.Sprintf("%s:%d", c.Address, c.Port)
-	conn, err := net.Dial(c.Network, addr)
+	md := pipeline.GetMetadata(ctx)
+	network := c.Network
+	addr := net.JoinHostPort(c.Address, strconv.Itoa(c.Port))
+	var conn net.Conn
+	var err error
+	if network == "unix" || network == "unixpacket" {
+		// Address is the socket path, "@name" for an abstract one
+		conn, err = pipeline.Dialer(ctx).DialContext(ctx, network, c.Address)
+	} else if c.Port == 0 {
+		// no fixed remote, dial wherever an inbound stage said the
+		// connection was going to. Unless the config pinned it the client
+		// had a say in that, through the server name or the address it
+		// connected to, so the destination policy applies.
+		if md == nil || md.Destination == nil {
+			return nil, errors.New("remote address format error")
+		}
+		if md.Destination.Pinned {
+			conn, err = pipeline.Dialer(ctx).DialContext(ctx, md.Destination.Network, md.Destination.String())
+		} else {
+			conn, err = pipeline.Dial(ctx, md.Destination.Network, md.Destination.String())
+		}
+	} else {
+		conn, err = pipeline.Dialer(ctx).DialContext(ctx, network, addr)
+	}
 	fmt.Println(conn, err)
 	if err != nil {
 		return nil, err
 	}
+	if c.ProxyProtocol != 0 && md != nil {
+		err = proxyproto.WriteHeader(conn, c.ProxyProtocol, md.Source, md.Local)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
 	dp, err := pipeline.NewDefaultPipeline(ctx, input, conn)
 	if err != nil {
@@ -49,7 +94,7 @@ func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipe
 		c,
 		dp,
 	}
-	go t.Transport()
+	pipeline.Go(ctx, t.Transport)
 	return t, nil
 }
 
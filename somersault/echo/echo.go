@@ -35,7 +35,7 @@ func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipe
 		c,
 		dp,
 	}
-	go e.Transport()
+	pipeline.Go(ctx, e.Transport)
 	return e, nil
 }
 
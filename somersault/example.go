@@ -0,0 +1,205 @@
+package somersault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const exampleHeader = `Every pipeline stage of this build. Copy the ones a listener needs into
+its pipeline, the first one faces the client. Required fields hold a
+placeholder, the others are commented out with their default.`
+
+// Example writes a config in format listing every registered stage with
+// its fields. json has no comments, it holds the required fields and the
+// defaults alone.
+func Example(format string) ([]byte, error) {
+	b := &bytes.Buffer{}
+	names := pipeline.PipelineNames()
+	switch format {
+	case FormatYAML:
+		writeComment(b, "", exampleHeader)
+		b.WriteString("config:\n  - address: 127.0.0.1\n    port: 1080\n    pipeline:\n")
+		for _, name := range names {
+			fields, err := pipeline.DescribePipeline(name)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(b, "\n      # %s\n      - protocol: %s\n        config:\n", name, name)
+			writeYAMLFields(b, fields, "          ", "          ", false)
+		}
+	case FormatTOML:
+		writeComment(b, "", exampleHeader)
+		b.WriteString("[[config]]\naddress = \"127.0.0.1\"\nport = 1080\n")
+		for _, name := range names {
+			fields, err := pipeline.DescribePipeline(name)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(b, "\n# %s\n[[config.pipeline]]\nprotocol = %q\n\n[config.pipeline.config]\n", name, name)
+			writeTOMLFields(b, fields, "config.pipeline.config", false)
+		}
+	case FormatJSON:
+		chain := make([]interface{}, len(names))
+		for i, name := range names {
+			fields, err := pipeline.DescribePipeline(name)
+			if err != nil {
+				return nil, err
+			}
+			chain[i] = map[string]interface{}{
+				"protocol": name,
+				"config":   exampleObject(fields),
+			}
+		}
+		c := map[string]interface{}{
+			"config": []interface{}{
+				map[string]interface{}{
+					"address":  "127.0.0.1",
+					"port":     1080,
+					"pipeline": chain,
+				},
+			},
+		}
+		buf, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		b.Write(buf)
+		b.WriteByte('\n')
+	default:
+		return nil, fmt.Errorf("%s: %s", UnknownFormat, format)
+	}
+	return b.Bytes(), nil
+}
+
+func writeComment(b *bytes.Buffer, indent, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(b, "%s# %s\n", indent, line)
+	}
+}
+
+// describeField is the comment after a field, its type and what it takes.
+func describeField(f pipeline.FieldInfo) string {
+	s := f.Type
+	if f.Required {
+		s += ", required"
+	}
+	if len(f.Enum) != 0 {
+		s += ", one of " + strings.Join(f.Enum, ", ")
+	}
+	return s
+}
+
+// exampleValue is the value of f in the example, its default or a
+// placeholder of its type, written for yaml and toml alike.
+func exampleValue(f pipeline.FieldInfo) string {
+	switch f.Type {
+	case "integer", "number", "bool", "size":
+		if f.Type == "size" && strings.Trim(f.Default, "0123456789") != "" {
+			// like "4MiB"
+			return strconv.Quote(f.Default)
+		}
+		if f.Default != "" {
+			return f.Default
+		}
+		if f.Type == "bool" {
+			return "false"
+		}
+		return "0"
+	case "map", "object":
+		return "{}"
+	}
+	if strings.HasPrefix(f.Type, "list of") {
+		return "[]"
+	}
+	return strconv.Quote(f.Default)
+}
+
+// writeYAMLFields writes fields, the first line with first in front and
+// the others with lead. Fields are commented out unless required, along
+// with what they hold.
+func writeYAMLFields(b *bytes.Buffer, fields []pipeline.FieldInfo, first, lead string, commented bool) {
+	for i, f := range fields {
+		prefix := lead
+		if i == 0 {
+			prefix = first
+		}
+		hide := !commented && !f.Required
+		if hide {
+			n := len(prefix) - len(strings.TrimLeft(prefix, " "))
+			prefix = prefix[:n] + "# " + prefix[n:]
+		}
+		// what f holds lines up under its key, behind the same comment
+		nested := strings.Map(func(r rune) rune {
+			if r == '#' {
+				return r
+			}
+			return ' '
+		}, prefix) + "  "
+		switch {
+		case f.Fields != nil && f.Type == "object":
+			fmt.Fprintf(b, "%s%s:  # %s\n", prefix, f.Key, describeField(f))
+			writeYAMLFields(b, f.Fields, nested, nested, commented || hide)
+		case f.Fields != nil:
+			fmt.Fprintf(b, "%s%s:  # %s\n", prefix, f.Key, describeField(f))
+			writeYAMLFields(b, f.Fields, nested+"- ", nested+"  ", commented || hide)
+		default:
+			fmt.Fprintf(b, "%s%s: %s  # %s\n", prefix, f.Key, exampleValue(f), describeField(f))
+		}
+	}
+}
+
+// writeTOMLFields writes fields of the table at path, values first and
+// the tables of objects after them.
+func writeTOMLFields(b *bytes.Buffer, fields []pipeline.FieldInfo, path string, commented bool) {
+	comment := func(f pipeline.FieldInfo) string {
+		if commented || !f.Required {
+			return "# "
+		}
+		return ""
+	}
+	for _, f := range fields {
+		if f.Fields == nil {
+			fmt.Fprintf(b, "%s%s = %s  # %s\n", comment(f), f.Key, exampleValue(f), describeField(f))
+		}
+	}
+	for _, f := range fields {
+		if f.Fields == nil {
+			continue
+		}
+		header := "[%s.%s]"
+		if f.Type != "object" {
+			header = "[[%s.%s]]"
+		}
+		fmt.Fprintf(b, "\n%s"+header+"  # %s\n", comment(f), path, f.Key, describeField(f))
+		writeTOMLFields(b, f.Fields, path+"."+f.Key, commented || !f.Required)
+	}
+}
+
+// exampleObject is the json example of fields, the required ones and
+// those with a default.
+func exampleObject(fields []pipeline.FieldInfo) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, f := range fields {
+		if !f.Required && f.Default == "" {
+			continue
+		}
+		if f.Fields != nil {
+			if f.Type == "object" {
+				m[f.Key] = exampleObject(f.Fields)
+			} else {
+				m[f.Key] = []interface{}{exampleObject(f.Fields)}
+			}
+			continue
+		}
+		var v interface{}
+		if json.Unmarshal([]byte(exampleValue(f)), &v) == nil {
+			m[f.Key] = v
+		}
+	}
+	return m
+}
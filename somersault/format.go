@@ -0,0 +1,395 @@
+package somersault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// Formats of a config file.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+var UnknownFormat = errors.New("unknown config format")
+
+// FormatOf picks the format of a config file by its extension, json when
+// the extension is not one of a format.
+func FormatOf(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// ParseConfigFormat decodes and validates a config written in format into
+// the model of the json config, see ParseConfig. Errors locate the
+// offending value by its path and by its line and column in data.
+func ParseConfigFormat(data []byte, format string) (*Config, error) {
+	src := &source{format: format, data: data}
+	tree, err := src.parse()
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfig(tree, src, nil)
+}
+
+// source is a config file, name is empty for a config not read from one.
+type source struct {
+	name   string
+	format string
+	data   []byte
+}
+
+// errorf formats an error at line and column of s, when known.
+func (s *source) errorf(line, column int, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if line > 0 {
+		msg = fmt.Sprintf("line %d column %d: %s", line, column, msg)
+	}
+	if s.name != "" {
+		msg = s.name + ": " + msg
+	}
+	return errors.New(msg)
+}
+
+// parse decodes s into the values json decodes to, numbers kept as
+// written.
+func (s *source) parse() (interface{}, error) {
+	switch s.format {
+	case FormatJSON:
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(s.data))
+		dec.UseNumber()
+		err := dec.Decode(&v)
+		if err == nil {
+			offset := dec.InputOffset()
+			if _, err := dec.Token(); err != io.EOF {
+				offset += int64(len(s.data[offset:]) - len(bytes.TrimLeft(s.data[offset:], " \t\r\n")))
+				line, column := position(s.data, offset)
+				return nil, s.errorf(line, column, "invalid data after the config")
+			}
+		}
+		if se, ok := err.(*json.SyntaxError); ok {
+			// Offset counts the offending character as read
+			offset := se.Offset
+			if offset > 0 {
+				offset--
+			}
+			line, column := position(s.data, offset)
+			return nil, s.errorf(line, column, "%s", se)
+		} else if err == io.EOF {
+			return nil, s.errorf(0, 0, "empty config")
+		} else if err == io.ErrUnexpectedEOF {
+			line, column := position(s.data, int64(len(s.data)))
+			return nil, s.errorf(line, column, "unexpected end of the config")
+		} else if err != nil {
+			return nil, s.errorf(0, 0, "%s", err)
+		}
+		return v, nil
+	case FormatYAML:
+		var doc yaml.Node
+		err := yaml.Unmarshal(s.data, &doc)
+		if err != nil {
+			return nil, s.errorf(0, 0, "%s", err)
+		}
+		v, err := yamlValue(&doc)
+		if err != nil {
+			return nil, s.errorf(0, 0, "%s", err)
+		}
+		if v == nil {
+			v = map[string]interface{}{}
+		}
+		return v, nil
+	case FormatTOML:
+		v := make(map[string]interface{})
+		err := toml.Unmarshal(s.data, &v)
+		if pe, ok := err.(toml.ParseError); ok {
+			return nil, s.errorf(pe.Position.Line, pe.Position.Col, "%s", pe.Message)
+		} else if err != nil {
+			return nil, s.errorf(0, 0, "%s", err)
+		}
+		return tomlValue(v), nil
+	}
+	return nil, fmt.Errorf("%s: %s", UnknownFormat, s.format)
+}
+
+// tomlValue turns the arrays of tables toml decodes to into lists like
+// those of json.
+func tomlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = tomlValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = tomlValue(item)
+		}
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = tomlValue(item)
+		}
+		return list
+	}
+	return v
+}
+
+// decodeConfig decodes and validates the values of a config, errors are
+// located in src, or in the file a value came from when o is set.
+func decodeConfig(tree interface{}, src *source, o *origins) (*Config, error) {
+	// the values json decodes to whatever the format
+	buf, err := json.Marshal(tree)
+	if err != nil {
+		return nil, src.errorf(0, 0, "%s", err)
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(buf, &m) != nil {
+		return nil, src.errorf(0, 0, "must be an object")
+	}
+	c := &Config{}
+	err = pipeline.Decode(c, m)
+	if err != nil {
+		return nil, locateError(err, tree, src, o)
+	}
+	return c, nil
+}
+
+// locateError adds where the value err is about is to err.
+func locateError(err error, tree interface{}, src *source, o *origins) error {
+	ce, ok := err.(*pipeline.ConfigError)
+	if !ok {
+		return src.errorf(0, 0, "%s", err)
+	}
+	path := ce.Path
+	if o != nil {
+		src, path = o.find(tree, src, path)
+	}
+	line, column, _ := locate(src.data, src.format, path)
+	return src.errorf(line, column, "%s", &pipeline.ConfigError{Path: path, Err: ce.Err})
+}
+
+// location is where a value starts in a config file, from 1.
+type location struct {
+	line, column int
+}
+
+// locate finds the value at path in data, or the closest value containing
+// it when it is missing, like the object a required field is missing
+// from.
+func locate(data []byte, format, path string) (int, int, bool) {
+	var locations map[string]location
+	switch format {
+	case FormatJSON:
+		locations = jsonLocations(data)
+	case FormatYAML:
+		locations = yamlLocations(data)
+	case FormatTOML:
+		locations = tomlLocations(data)
+	}
+	for {
+		if l, ok := locations[path]; ok {
+			return l.line, l.column, true
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i <= 0 {
+			return 0, 0, false
+		}
+		path = path[:i]
+	}
+}
+
+// joinPath adds key to path the way pipeline.FieldError does.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// jsonLocations maps the path of every value of the json data to where it
+// starts.
+func jsonLocations(data []byte) map[string]location {
+	locations := make(map[string]location)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		// the decoder stops before the colon or comma ahead of a value
+		offset := dec.InputOffset()
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+			offset++
+		}
+		line, column := position(data, offset)
+		locations[path] = location{line, column}
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				name, _ := key.(string)
+				err = walk(joinPath(path, name))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				err = walk(indexPath(path, i))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	walk("")
+	return locations
+}
+
+// yamlValue converts the yaml node n into the values json decodes to.
+func yamlValue(n *yaml.Node) (interface{}, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return yamlValue(n.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(n.Alias)
+	case yaml.SequenceNode:
+		list := make([]interface{}, len(n.Content))
+		for i, item := range n.Content {
+			v, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case yaml.MappingNode:
+		m := make(map[string]interface{}, len(n.Content)/2)
+		var merges []interface{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("yaml: line %d: keys must be strings", key.Line)
+			}
+			v, err := yamlValue(value)
+			if err != nil {
+				return nil, err
+			}
+			if key.Tag == "!!merge" {
+				merges = append(merges, v)
+				continue
+			}
+			m[key.Value] = v
+		}
+		// keys of the mapping win over those merged in, and earlier
+		// merged mappings over later ones
+		for _, v := range merges {
+			list, ok := v.([]interface{})
+			if !ok {
+				list = []interface{}{v}
+			}
+			for _, item := range list {
+				merged, _ := item.(map[string]interface{})
+				for k, mv := range merged {
+					if _, ok := m[k]; !ok {
+						m[k] = mv
+					}
+				}
+			}
+		}
+		return m, nil
+	}
+	var v interface{}
+	err := n.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// yamlLocations maps the path of every value of the yaml data to where it
+// starts.
+func yamlLocations(data []byte) map[string]location {
+	locations := make(map[string]location)
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil {
+		return locations
+	}
+	// at is where the value starts, its key for a block mapping or
+	// sequence starting on the next line
+	var walk func(n, at *yaml.Node, path string)
+	walk = func(n, at *yaml.Node, path string) {
+		if n.Kind == yaml.DocumentNode {
+			if len(n.Content) != 0 {
+				walk(n.Content[0], n.Content[0], path)
+			}
+			return
+		}
+		if _, ok := locations[path]; !ok {
+			locations[path] = location{at.Line, at.Column}
+		}
+		switch n.Kind {
+		case yaml.AliasNode:
+			walk(n.Alias, at, path)
+		case yaml.SequenceNode:
+			for i, item := range n.Content {
+				walk(item, item, indexPath(path, i))
+			}
+		case yaml.MappingNode:
+			var merges []*yaml.Node
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key, value := n.Content[i], n.Content[i+1]
+				if key.Tag == "!!merge" {
+					merges = append(merges, value)
+					continue
+				}
+				at := value
+				if (value.Kind == yaml.MappingNode || value.Kind == yaml.SequenceNode) && value.Style&yaml.FlowStyle == 0 {
+					at = key
+				}
+				walk(value, at, joinPath(path, key.Value))
+			}
+			for _, value := range merges {
+				if value.Kind == yaml.SequenceNode {
+					for _, item := range value.Content {
+						walk(item, item, path)
+					}
+				} else {
+					walk(value, value, path)
+				}
+			}
+		}
+	}
+	walk(&doc, &doc, "")
+	return locations
+}
@@ -0,0 +1,142 @@
+package somersault
+
+import (
+	"strings"
+	"testing"
+)
+
+const locateJSON = `{
+  "grace_period": "1s",
+  "config": [
+    {"address": "a", "port": 1},
+    {
+      "pipeline": ["echo", {"protocol": "tcp"}]
+    }
+  ]
+}`
+
+const locateYAML = `grace_period: 1s
+config:
+  - address: a
+    port: 1
+  - pipeline:
+      - echo
+      - {protocol: tcp}
+base: &base
+  port: 2
+merged:
+  <<: *base
+  address: b
+`
+
+const locateTOML = `grace_period = "1s"
+
+[[config]]
+address = "a"
+port = 1
+
+[[config]]
+pipeline = ["echo", {protocol = "tcp"}]
+
+[quota]
+file = "q"
+limits.alice = {upload = "1GiB"}
+`
+
+func TestLocate(t *testing.T) {
+	tests := []struct {
+		format, data, path string
+		line, column       int
+		found              bool
+	}{
+		{FormatJSON, locateJSON, "grace_period", 2, 19, true},
+		{FormatJSON, locateJSON, "config", 3, 13, true},
+		{FormatJSON, locateJSON, "config[0]", 4, 5, true},
+		{FormatJSON, locateJSON, "config[0].port", 4, 30, true},
+		{FormatJSON, locateJSON, "config[1]", 5, 5, true},
+		{FormatJSON, locateJSON, "config[1].pipeline[0]", 6, 20, true},
+		{FormatJSON, locateJSON, "config[1].pipeline[1].protocol", 6, 41, true},
+		// missing values are located at what holds them
+		{FormatJSON, locateJSON, "config[0].name", 4, 5, true},
+		{FormatJSON, locateJSON, "config[1].pipeline[1].config.port", 6, 28, true},
+		{FormatJSON, locateJSON, "admin.token", 0, 0, false},
+
+		{FormatYAML, locateYAML, "grace_period", 1, 15, true},
+		{FormatYAML, locateYAML, "config", 2, 1, true},
+		{FormatYAML, locateYAML, "config[0]", 3, 5, true},
+		{FormatYAML, locateYAML, "config[0].port", 4, 11, true},
+		{FormatYAML, locateYAML, "config[1].pipeline", 5, 5, true},
+		{FormatYAML, locateYAML, "config[1].pipeline[0]", 6, 9, true},
+		{FormatYAML, locateYAML, "config[1].pipeline[1]", 7, 9, true},
+		{FormatYAML, locateYAML, "config[1].pipeline[1].protocol", 7, 20, true},
+		{FormatYAML, locateYAML, "merged.port", 9, 9, true},
+		{FormatYAML, locateYAML, "merged.address", 12, 12, true},
+		{FormatYAML, locateYAML, "config[2]", 2, 1, true},
+
+		{FormatTOML, locateTOML, "grace_period", 1, 16, true},
+		{FormatTOML, locateTOML, "config[0]", 3, 1, true},
+		{FormatTOML, locateTOML, "config[0].port", 5, 8, true},
+		{FormatTOML, locateTOML, "config[1]", 7, 1, true},
+		{FormatTOML, locateTOML, "config[1].pipeline", 8, 12, true},
+		{FormatTOML, locateTOML, "config[1].pipeline[0]", 8, 13, true},
+		{FormatTOML, locateTOML, "config[1].pipeline[1].protocol", 8, 33, true},
+		{FormatTOML, locateTOML, "quota", 10, 1, true},
+		{FormatTOML, locateTOML, "quota.file", 11, 8, true},
+		{FormatTOML, locateTOML, "quota.limits.alice", 12, 16, true},
+		{FormatTOML, locateTOML, "quota.limits.alice.upload", 12, 26, true},
+	}
+	for _, tt := range tests {
+		line, column, found := locate([]byte(tt.data), tt.format, tt.path)
+		if line != tt.line || column != tt.column || found != tt.found {
+			t.Errorf("%s %s: %d:%d %v, want %d:%d %v", tt.format, tt.path, line, column, found, tt.line, tt.column, tt.found)
+		}
+	}
+}
+
+func TestParseConfigFormatErrors(t *testing.T) {
+	tests := []struct {
+		format, data, err string
+	}{
+		{FormatJSON, "{\n  \"config\": [{\"address\": \"127.0.0.1\", \"port\": 70000, \"pipeline\": [\"echo\"]}]\n}",
+			"line 2 column 47: config[0].port: must be 1-65535"},
+		{FormatYAML, "config:\n  - address: 127.0.0.1\n    port: 70000\n    pipeline: [echo]\n",
+			"line 3 column 11: config[0].port: must be 1-65535"},
+		{FormatTOML, "[[config]]\naddress = \"127.0.0.1\"\nport = 70000\npipeline = [\"echo\"]\n",
+			"line 3 column 8: config[0].port: must be 1-65535"},
+		{FormatYAML, "config:\n  - address: 127.0.0.1\n    port: 1080\n",
+			"line 2 column 5: config[0].pipeline: empty pipeline"},
+		{FormatYAML, "grace_period: soon\n", "line 1 column 15: grace_period:"},
+		{FormatYAML, "config:\n  - http://127.0.0.1:8080?idle_timeout=soon\n",
+			"line 2 column 5: config[0].idle_timeout: invalid duration"},
+		{FormatYAML, "admin:\n  address: 127.0.0.1:9090\n  tokn: x\n", "line 3 column 9: admin.tokn: unknown field"},
+		{FormatJSON, `{"config": [],}`, "line 1 column 15: invalid character '}'"},
+		{FormatJSON, "{\n  \"config\": [\n", "line 3 column 1: unexpected end of the config"},
+		{FormatJSON, "{}\n  {}", "line 2 column 3: invalid data after the config"},
+		{FormatJSON, "", "empty config"},
+		{FormatTOML, "config = [\n", "line 1 column 11: unexpected EOF"},
+		{FormatYAML, "config: [\n", "yaml:"},
+		{"ini", "", UnknownFormat.Error()},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfigFormat([]byte(tt.data), tt.format)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: error %v, want %q", tt.format, tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	tests := map[string]string{
+		"a.json":       FormatJSON,
+		"a.YAML":       FormatYAML,
+		"conf.d/a.yml": FormatYAML,
+		"a.toml":       FormatTOML,
+		"a":            FormatJSON,
+		"a.conf":       FormatJSON,
+	}
+	for name, want := range tests {
+		if got := FormatOf(name); got != want {
+			t.Errorf("FormatOf(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
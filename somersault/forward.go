@@ -0,0 +1,124 @@
+package somersault
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// Forward is a static port forward in the spirit of ssh -L and -R.
+//
+// A "local" forward listens on Listen here and reaches Target through the
+// Via chain, a direct dial when it is empty.
+//
+// A "remote" forward asks the tunnel stage at Server to listen on Listen
+// on its side and carries those connections back here, where Target is
+// reached through Via. The tunnel stage must allow binding.
+type Forward struct {
+	Type    string        `json:"type"`
+	Network string        `json:"network"`
+	Listen  string        `json:"listen"`
+	Target  string        `json:"target"`
+	Via     []interface{} `json:"via"`
+	Server  string        `json:"server"`
+	Token   string        `json:"token"`
+	Name    string        `json:"name"`
+}
+
+func splitAddress(addr, defaultHost string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %s", addr)
+	}
+	if host == "" {
+		host = defaultHost
+	}
+	return host, port, nil
+}
+
+// entry expands the forward into a listener entry of Config.
+func (f *Forward) entry() (*Listener, error) {
+	network := f.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "udp" {
+		return nil, pipeline.FieldError("network", fmt.Errorf("unsupported network %s", network))
+	}
+	// like ssh, a forward without a host only listens on loopback
+	listenHost, listenPort, err := splitAddress(f.Listen, "127.0.0.1")
+	if err != nil {
+		return nil, pipeline.FieldError("listen", err)
+	}
+	targetHost, targetPort, err := splitAddress(f.Target, "127.0.0.1")
+	if err != nil {
+		return nil, pipeline.FieldError("target", err)
+	}
+
+	chain := []interface{}{
+		map[string]interface{}{
+			"protocol": "forward",
+			"config": map[string]interface{}{
+				"network": network,
+				"address": targetHost,
+				"port":    targetPort,
+			},
+		},
+	}
+	if len(f.Via) != 0 {
+		// checked on its own for errors to name the via stages
+		_, err := pipeline.ParseChain(f.Via)
+		if err != nil {
+			return nil, pipeline.FieldError("via", err)
+		}
+		chain = append(chain, f.Via...)
+	} else {
+		chain = append(chain, map[string]interface{}{
+			"protocol": "tcp",
+			"config":   map[string]interface{}{},
+		})
+	}
+
+	switch f.Type {
+	case "", "local":
+		return &Listener{
+			Network: network,
+			Address: listenHost,
+			Port:    listenPort,
+			// a socket systemd opens for it
+			Name:         f.Name,
+			RouteOptions: RouteOptions{Pipeline: chain},
+		}, nil
+	case "remote":
+		if network != "tcp" {
+			return nil, pipeline.FieldError("network", errors.New("remote forwards only support tcp"))
+		}
+		serverHost, serverPort, err := splitAddress(f.Server, "")
+		if err != nil {
+			return nil, pipeline.FieldError("server", err)
+		}
+		name := f.Name
+		if name == "" {
+			name = "forward-" + f.Listen
+		}
+		return &Listener{
+			Network:      "reverse",
+			Address:      serverHost,
+			Port:         serverPort,
+			RouteOptions: RouteOptions{Pipeline: chain},
+			Options: map[string]interface{}{
+				"tunnel": name,
+				"token":  f.Token,
+				"bind":   net.JoinHostPort(listenHost, strconv.Itoa(listenPort)),
+			},
+		}, nil
+	}
+	return nil, pipeline.FieldError("type", fmt.Errorf("unknown type %s", f.Type))
+}
@@ -0,0 +1,59 @@
+package forward
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var NoMetadata = errors.New("metadata not found")
+
+// Config is the "forward" stage, it pins the destination of every
+// connection to one address. The stages after it decide how to get there,
+// a "tcp" stage without a port dials it directly and a socks5 stage with a
+// server goes through that hop.
+type Config struct {
+	Network string `somersault:"network"`
+	Address string `somersault:"address,required"`
+	Port    int    `somersault:"port,required"`
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{
+		Network: c.Network,
+		Address: c.Address,
+		Port:    c.Port,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return pipeline.FieldError("port", errors.New("must be 1-65535"))
+	}
+	return nil
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if c.Address == "" || c.Port == 0 {
+		return nil, errors.New("forward address format error")
+	}
+	md := pipeline.GetMetadata(ctx)
+	if md == nil {
+		return nil, NoMetadata
+	}
+	md.Destination = &pipeline.Address{
+		Network: c.Network,
+		Host:    c.Address,
+		Port:    c.Port,
+		Pinned:  true,
+	}
+	return input, nil
+}
+
+func init() {
+	config := &Config{
+		Network: "tcp",
+	}
+	pipeline.RegistePipelineCreator("forward", config)
+}
@@ -0,0 +1,187 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var (
+	MissingHost = errors.New("request has no host")
+	AuthFailed  = errors.New("authentication failed")
+)
+
+// Config is an http proxy server handling CONNECT tunnels and plain
+// requests with an absolute uri. With Users, mapping user names to
+// passwords, clients must authenticate with basic proxy authorization.
+type Config struct {
+	Network string            `somersault:"network"`
+	Users   map[string]string `somersault:"users"`
+}
+
+type HTTP struct {
+	*Config
+	*pipeline.DefaultPipeline
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{
+		Network: c.Network,
+		Users:   c.Users,
+	}
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	reader := bufio.NewReader(input)
+	output, err := c.HandshakeReply(ctx, input, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// whatever the client pipelined after its request
+	if n := reader.Buffered(); n != 0 {
+		buf, _ := reader.Peek(n)
+		input = pipeline.NewReplay(buf, input)
+	}
+	dp, err := pipeline.NewDefaultPipeline(ctx, input, output)
+	if err != nil {
+		return nil, err
+	}
+	h := &HTTP{
+		c,
+		dp,
+	}
+	pipeline.Go(ctx, h.Transport)
+	return h, nil
+}
+
+func reply(input pipeline.Pipeline, status int) error {
+	var err error
+	if status == http.StatusOK {
+		_, err = fmt.Fprint(input, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else if status == http.StatusProxyAuthRequired {
+		_, err = fmt.Fprintf(input, "HTTP/1.1 %d %s\r\nProxy-Authenticate: Basic realm=\"somersault\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+	} else {
+		_, err = fmt.Fprintf(input, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+	}
+	return err
+}
+
+// authenticate checks the Proxy-Authorization of req and returns the user.
+func (c *Config) authenticate(req *http.Request) (string, error) {
+	if len(c.Users) == 0 {
+		return "", nil
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, credentials, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return "", AuthFailed
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", AuthFailed
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", AuthFailed
+	}
+	want, ok := c.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(password)) != 1 {
+		return "", AuthFailed
+	}
+	return user, nil
+}
+
+func (c *Config) HandshakeReply(ctx context.Context, input pipeline.Pipeline, reader *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	user, err := c.authenticate(req)
+	if err != nil {
+		reply(input, http.StatusProxyAuthRequired)
+		return nil, err
+	}
+	md := pipeline.GetMetadata(ctx)
+	if md != nil {
+		err = md.SetUser(user)
+		if err != nil {
+			reply(input, http.StatusForbidden)
+			return nil, err
+		}
+	}
+
+	host := req.Host
+	port := "80"
+	if req.Method == http.MethodConnect {
+		port = "443"
+	} else if req.URL.Host != "" {
+		host = req.URL.Host
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if host == "" {
+		reply(input, http.StatusBadRequest)
+		return nil, MissingHost
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	if md != nil {
+		h, p, _ := net.SplitHostPort(host)
+		md.Destination = &pipeline.Address{Network: c.Network, Host: h}
+		md.Destination.Port, _ = net.LookupPort(c.Network, p)
+	}
+
+	conn, err := pipeline.Dial(ctx, c.Network, host)
+	if errors.Is(err, pipeline.DestinationForbidden) {
+		reply(input, http.StatusForbidden)
+		return nil, err
+	} else if err != nil {
+		reply(input, http.StatusBadGateway)
+		return nil, err
+	}
+
+	if req.Method == http.MethodConnect {
+		err = reply(input, http.StatusOK)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	// forward the request in origin form, one request per connection
+	// since the next one may be for another host
+	req.RequestURI = ""
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func init() {
+	config := &Config{
+		Network: "tcp",
+	}
+	pipeline.RegistePipelineCreator("http", config)
+}
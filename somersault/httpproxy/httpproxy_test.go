@@ -0,0 +1,44 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	c := &Config{Users: map[string]string{"alice": "1234"}}
+	tests := []struct {
+		name   string
+		header string
+		user   string
+		err    error
+	}{
+		{"accepted", basic("alice:1234"), "alice", nil},
+		{"lower case scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("alice:1234")), "alice", nil},
+		{"wrong password", basic("alice:123"), "", AuthFailed},
+		{"unknown user", basic("bob:1234"), "", AuthFailed},
+		{"no colon", basic("alice"), "", AuthFailed},
+		{"bad base64", "Basic !!!", "", AuthFailed},
+		{"other scheme", "Bearer 1234", "", AuthFailed},
+		{"missing", "", "", AuthFailed},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Header: http.Header{}}
+		if tt.header != "" {
+			req.Header.Set("Proxy-Authorization", tt.header)
+		}
+		user, err := c.authenticate(req)
+		if err != tt.err || user != tt.user {
+			t.Errorf("%s: got %q, %v", tt.name, user, err)
+		}
+	}
+
+	open := &Config{}
+	if user, err := open.authenticate(&http.Request{Header: http.Header{}}); err != nil || user != "" {
+		t.Errorf("without users: got %q, %v", user, err)
+	}
+}
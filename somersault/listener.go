@@ -0,0 +1,40 @@
+package somersault
+
+import (
+	"context"
+	"net"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+func (s *Somerasult) listen(e *entry) (net.Listener, error) {
+	ctx := pipeline.WithLogger(context.Background(), s.logger)
+	network := e.network
+	c, err := pipeline.GetListenerCreator(network, e.listener.Options)
+	if err == nil {
+		return c.Listen(ctx, e.address, e.port)
+	} else if err != pipeline.ListenerNotFound {
+		return nil, err
+	}
+
+	if isUnixNetwork(network) {
+		return s.listenUnix(network, e.address, e.listener)
+	}
+
+	lc := net.ListenConfig{}
+	transparent := e.listener.Transparent
+	if transparent {
+		lc.Control = transparentControl
+	}
+
+	addr := e.addr
+	switch network {
+	case "udp", "udp4", "udp6":
+		conn, err := lc.ListenPacket(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newPacketListener(conn.(*net.UDPConn), transparent, s.logger), nil
+	}
+	return lc.Listen(ctx, network, addr)
+}
@@ -0,0 +1,100 @@
+package somersault
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// missing from the syscall package
+const (
+	ipv6RecvOrigDstAddr = 74
+	ipv6Transparent     = 75
+)
+
+func setTransparent(fd int, network string) error {
+	udp := strings.HasPrefix(network, "udp")
+	if strings.HasSuffix(network, "6") {
+		err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+		if err != nil {
+			return err
+		}
+		if udp {
+			err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+			if err != nil {
+				return err
+			}
+		}
+		// dual stack sockets also receive ipv4 traffic, a v6only socket
+		// refuses the ipv4 options which is fine
+		syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if udp {
+			syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+		}
+		return nil
+	}
+
+	err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	if err != nil {
+		return err
+	}
+	if udp {
+		return syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+	}
+	return nil
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = setTransparent(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// transparentReplyControl allows binding the non local original
+// destination, several sessions may share it.
+func transparentReplyControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if serr != nil {
+			return
+		}
+		serr = setTransparent(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseOriginalDestination finds IP_ORIGDSTADDR or IPV6_ORIGDSTADDR in the
+// ancillary data of a datagram received on a transparent socket.
+func parseOriginalDestination(oob []byte) *net.UDPAddr {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(msg.Data) >= 24:
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, msg.Data[8:24])
+			return &net.UDPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package somersault
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// cmsg builds the ancillary data of one control message.
+func cmsg(level, typ int, data []byte) []byte {
+	buf := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&buf[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(buf[syscall.CmsgLen(0):], data)
+	return buf
+}
+
+func TestParseOriginalDestination(t *testing.T) {
+	// sockaddr_in and sockaddr_in6, the port in network byte order
+	in := []byte{syscall.AF_INET, 0, 0x1f, 0x90, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	in6 := make([]byte, syscall.SizeofSockaddrInet6)
+	in6[0], in6[3] = syscall.AF_INET6, 53
+	copy(in6[8:24], net.ParseIP("2001:db8::1"))
+	other := cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0})
+
+	tests := []struct {
+		name string
+		oob  []byte
+		want string
+	}{
+		{"ipv4", cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, in), "10.0.0.1:8080"},
+		{"ipv6", cmsg(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, in6), "[2001:db8::1]:53"},
+		{"after another", append(other, cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, in)...), "10.0.0.1:8080"},
+		{"short", cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, in[:4]), ""},
+		{"missing", other, ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if addr := parseOriginalDestination(tt.oob); addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
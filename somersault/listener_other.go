@@ -0,0 +1,23 @@
+//go:build !linux
+
+package somersault
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errTransparent = errors.New("transparent proxy is only supported on linux")
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errTransparent
+}
+
+func transparentReplyControl(network, address string, c syscall.RawConn) error {
+	return errTransparent
+}
+
+func parseOriginalDestination(oob []byte) *net.UDPAddr {
+	return nil
+}
@@ -0,0 +1,475 @@
+package somersault
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// A config file may pull in others and take values from the environment
+// and from files,
+//
+//	include: conf.d                     # files, directories or globs
+//	password: ${SOCKS_PASSWORD}         # ${NAME:-default} when it may be unset
+//	psk: file:/etc/somersault/psk       # the content of a file
+//
+// Included files are read in order, those of a directory by name, and
+// merged into the including one: lists are appended, objects merged and a
+// value set twice is refused. Relative paths are relative to the file
+// they are written in. $${ is a literal ${.
+//
+// Any string value written starting with file: is read from the file it
+// names, whatever the option, while one a variable expands to file: is
+// taken as it is. $file: is a literal file:. A secret file must belong to
+// us or root and must not be accessible to its group or others, see
+// checkSecret.
+const secretPrefix = "file:"
+
+var IncludeCycle = errors.New("included by itself")
+
+// LoadConfig reads the config file fileName in format, by its extension
+// when empty, with the files it includes, its variables and secrets
+// resolved before the stages decode their configs. Errors name the file
+// and the line of the offending value.
+func LoadConfig(fileName, format string) (*Config, error) {
+	l := newLoader()
+	tree, src, err := l.load(fileName, format)
+	if err != nil {
+		return nil, err
+	}
+	err = l.resolve(tree, tree, src, "")
+	if err != nil {
+		return nil, locateError(err, tree, src, l.origins)
+	}
+	return decodeConfig(tree, src, l.origins)
+}
+
+type loader struct {
+	origins *origins
+	// loading holds the files being read, to refuse include cycles
+	loading map[string]bool
+}
+
+func newLoader() *loader {
+	return &loader{
+		origins: &origins{
+			nodes:   make(map[uintptr]origin),
+			entries: make(map[entryKey]origin),
+		},
+		loading: make(map[string]bool),
+	}
+}
+
+// load reads fileName and merges the files it includes into it.
+func (l *loader) load(fileName, format string) (map[string]interface{}, *source, error) {
+	if format == "" {
+		format = FormatOf(fileName)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := &source{name: fileName, format: format, data: data}
+	v, err := src.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, src.errorf(1, 1, "must be an object")
+	}
+	l.origins.add(tree, src, "")
+
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l.loading[abs] {
+		return nil, nil, fmt.Errorf("%s: %s", fileName, IncludeCycle)
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+
+	include, ok := tree["include"]
+	if !ok {
+		return tree, src, nil
+	}
+	delete(tree, "include")
+	files, err := includedFiles(filepath.Dir(fileName), include)
+	if err != nil {
+		return nil, nil, locateError(pipeline.FieldError("include", err), tree, src, nil)
+	}
+	for _, file := range files {
+		fragment, fsrc, err := l.load(file, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		err = l.merge(tree, fragment)
+		if err != nil {
+			return nil, nil, locateError(err, fragment, fsrc, l.origins)
+		}
+	}
+	return tree, src, nil
+}
+
+// includedFiles lists the files include names, a path or a list of them.
+// Directories give their config files by name, a glob may match nothing.
+func includedFiles(dir string, include interface{}) ([]string, error) {
+	var patterns []string
+	switch v := include.(type) {
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for i, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, pipeline.FieldError(fmt.Sprintf("[%d]", i), errors.New("must be a path"))
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, errors.New("must be a path or a list of paths")
+	}
+
+	var files []string
+	for i, pattern := range patterns {
+		pattern, err := expandEnv(pattern)
+		if err != nil {
+			return nil, pipeline.FieldError(fmt.Sprintf("[%d]", i), err)
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, pipeline.FieldError(fmt.Sprintf("[%d]", i), err)
+		}
+		if matches == nil && !strings.ContainsAny(pattern, "*?[") {
+			return nil, pipeline.FieldError(fmt.Sprintf("[%d]", i), fmt.Errorf("%s does not exist", pattern))
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			// ReadDir sorts by name, skip what editors leave around
+			for _, e := range entries {
+				switch strings.ToLower(filepath.Ext(e.Name())) {
+				case ".json", ".yaml", ".yml", ".toml":
+					if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+						files = append(files, filepath.Join(match, e.Name()))
+					}
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// merge adds the values of src to those of dst, appending lists and
+// merging objects. A value in both is refused.
+func (l *loader) merge(dst, src map[string]interface{}) error {
+	keys := make([]string, 0, len(src))
+	for key := range src {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := src[key]
+		old, ok := dst[key]
+		switch {
+		case !ok:
+			dst[key] = v
+		case isObject(old) && isObject(v):
+			err := l.merge(old.(map[string]interface{}), v.(map[string]interface{}))
+			if err != nil {
+				return pipeline.FieldError(key, err)
+			}
+			continue
+		case isList(old) && isList(v):
+			dst[key] = append(old.([]interface{}), v.([]interface{})...)
+			continue
+		default:
+			from := l.origins.entries[entryKey{nodeID(dst), key}]
+			return pipeline.FieldError(key, fmt.Errorf("already set in %s", from.src.name))
+		}
+		l.origins.entries[entryKey{nodeID(dst), key}] = l.origins.entries[entryKey{nodeID(src), key}]
+	}
+	return nil
+}
+
+func isObject(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+func isList(v interface{}) bool {
+	_, ok := v.([]interface{})
+	return ok
+}
+
+// resolve replaces the variables and secrets of the strings in v, which
+// is at path in tree.
+func (l *loader) resolve(tree, v interface{}, root *source, path string) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				err := l.resolve(tree, item, root, joinPath(path, key))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			s, err := l.resolveString(tree, root, joinPath(path, key), s)
+			if err != nil {
+				return err
+			}
+			v[key] = s
+		}
+	case []interface{}:
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				err := l.resolve(tree, item, root, indexPath(path, i))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			s, err := l.resolveString(tree, root, indexPath(path, i), s)
+			if err != nil {
+				return err
+			}
+			v[i] = s
+		}
+	}
+	return nil
+}
+
+func (l *loader) resolveString(tree interface{}, root *source, path, s string) (string, error) {
+	if strings.HasPrefix(s, "$"+secretPrefix) {
+		// a value that is not a secret but starts like one
+		s, err := expandEnv(s[1:])
+		return s, fieldError(path, err)
+	}
+	secret := strings.HasPrefix(s, secretPrefix)
+	if secret {
+		s = strings.TrimPrefix(s, secretPrefix)
+	}
+	s, err := expandEnv(s)
+	if err != nil || !secret {
+		return s, fieldError(path, err)
+	}
+	if !filepath.IsAbs(s) {
+		// relative to the file the value is written in
+		src, _ := l.origins.find(tree, root, path)
+		s = filepath.Join(filepath.Dir(src.name), s)
+	}
+	s, err = readSecret(s)
+	return s, fieldError(path, err)
+}
+
+// fieldError is err at path of the config.
+func fieldError(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &pipeline.ConfigError{Path: path, Err: err}
+}
+
+// expandEnv replaces ${NAME} and ${NAME:-default} in s, refusing unset
+// variables without a default.
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		name := s[i+2 : i+end]
+		s = s[i+end+1:]
+		def, hasDefault := "", false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, def, hasDefault = name[:j], name[j+2:], true
+		}
+		if !validEnvName(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		value, ok := os.LookupEnv(name)
+		if hasDefault && value == "" {
+			value, ok = def, true
+		}
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+	}
+}
+
+func validEnvName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// readSecret returns the content of the secret file name without its
+// final newline.
+func readSecret(name string) (string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a file", name)
+	}
+	err = checkSecret(name, info)
+	if err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSuffix(string(buf), "\n")
+	return strings.TrimSuffix(s, "\r"), nil
+}
+
+// origin is the file a value of the config comes from and its path there.
+type origin struct {
+	src  *source
+	path string
+}
+
+type entryKey struct {
+	node uintptr
+	key  string
+}
+
+// origins remembers where the objects of a config and their members come
+// from once included files are merged.
+type origins struct {
+	nodes   map[uintptr]origin
+	entries map[entryKey]origin
+}
+
+func nodeID(v interface{}) uintptr {
+	return reflect.ValueOf(v).Pointer()
+}
+
+// add records the objects of v, at path in src, with their members.
+func (o *origins) add(v interface{}, src *source, path string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		o.nodes[nodeID(v)] = origin{src, path}
+		for key, item := range v {
+			o.entries[entryKey{nodeID(v), key}] = origin{src, joinPath(path, key)}
+			o.add(item, src, joinPath(path, key))
+		}
+	case []interface{}:
+		for i, item := range v {
+			o.add(item, src, indexPath(path, i))
+		}
+	}
+}
+
+// find returns the file the value at path of tree comes from and its path
+// there, root when it is unknown.
+func (o *origins) find(tree interface{}, root *source, path string) (*source, string) {
+	at := origin{root, ""}
+	node := tree
+	for _, segment := range splitPath(path) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if e, ok := o.entries[entryKey{nodeID(n), segment}]; ok {
+				at = e
+			} else {
+				at.path = joinPath(at.path, segment)
+			}
+			node = n[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(strings.Trim(segment, "[]"))
+			if err != nil || i < 0 || i >= len(n) {
+				at.path += segment
+				node = nil
+				continue
+			}
+			at.path = indexPath(at.path, i)
+			node = n[i]
+			if _, ok := node.(map[string]interface{}); ok {
+				if e, ok := o.nodes[nodeID(node)]; ok {
+					at = e
+				}
+			}
+		default:
+			if strings.HasPrefix(segment, "[") {
+				at.path += segment
+			} else {
+				at.path = joinPath(at.path, segment)
+			}
+		}
+	}
+	return at.src, at.path
+}
+
+// splitPath splits a path like config[2].pipeline into config, [2] and
+// pipeline.
+func splitPath(path string) []string {
+	var segments []string
+	for path != "" {
+		switch {
+		case path[0] == '.':
+			path = path[1:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return append(segments, path)
+			}
+			segments = append(segments, path[:end+1])
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			segments = append(segments, path[:end])
+			path = path[end:]
+		}
+	}
+	return segments
+}
@@ -0,0 +1,212 @@
+package somersault
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// loadTree reads and resolves fileName like LoadConfig, without decoding.
+func loadTree(fileName string) (map[string]interface{}, error) {
+	l := newLoader()
+	tree, src, err := l.load(fileName, "")
+	if err != nil {
+		return nil, err
+	}
+	err = l.resolve(tree, tree, src, "")
+	if err != nil {
+		return nil, locateError(err, tree, src, l.origins)
+	}
+	return tree, nil
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("T_SET", "set")
+	t.Setenv("T_EMPTY", "")
+	t.Setenv("T_FILE", "file:psk")
+	os.Unsetenv("T_UNSET")
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		// modes of the files, 0600 when missing
+		modes map[string]os.FileMode
+		want  map[string]interface{}
+		err   string
+	}{
+		{
+			name: "include directory",
+			files: map[string]string{
+				"main.yaml":        "include: conf.d\nconfig: [a]\nadmin: {address: x}\n",
+				"conf.d/1.yaml":    "config: [b]\nquota: {file: q}\n",
+				"conf.d/2.json":    `{"config": ["c"], "admin": {"token": "t"}}`,
+				"conf.d/.3.yaml":   "config: [hidden]\n",
+				"conf.d/notes.txt": "config: [text]\n",
+			},
+			want: map[string]interface{}{
+				"config": []interface{}{"a", "b", "c"},
+				"admin":  map[string]interface{}{"address": "x", "token": "t"},
+				"quota":  map[string]interface{}{"file": "q"},
+			},
+		},
+		{
+			name: "include list and glob",
+			files: map[string]string{
+				"main.yaml":    "include: [a.yaml, 'extra/*.yaml', 'none/*.yaml']\nconfig: [main]\n",
+				"a.yaml":       "config: [a]\n",
+				"extra/b.yml":  "config: [b]\n",
+				"extra/c.yaml": "config: [c]\n",
+			},
+			want: map[string]interface{}{"config": []interface{}{"main", "a", "c"}},
+		},
+		{
+			name:  "include missing",
+			files: map[string]string{"main.yaml": "include: missing.yaml\n"},
+			err:   "does not exist",
+		},
+		{
+			name: "set twice",
+			files: map[string]string{
+				"main.yaml": "include: a.yaml\ngrace_period: 1s\n",
+				"a.yaml":    "grace_period: 2s\n",
+			},
+			err: "a.yaml: line 1 column 15: grace_period: already set in",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.yaml": "include: a.yaml\n",
+				"a.yaml":    "include: main.yaml\n",
+			},
+			err: IncludeCycle.Error(),
+		},
+		{
+			name: "env",
+			files: map[string]string{
+				"main.yaml": "a: ${T_SET}\nb: x-${T_UNSET:-def}-y\nc: $${T_SET}\nd: ${T_EMPTY:-empty}\nlist: ['${T_SET}']\n",
+			},
+			want: map[string]interface{}{
+				"a":    "set",
+				"b":    "x-def-y",
+				"c":    "${T_SET}",
+				"d":    "empty",
+				"list": []interface{}{"set"},
+			},
+		},
+		{
+			name:  "env unset",
+			files: map[string]string{"main.yaml": "admin:\n  token: ${T_UNSET}\n"},
+			err:   "main.yaml: line 2 column 10: admin.token: environment variable T_UNSET is not set",
+		},
+		{
+			name:  "env invalid name",
+			files: map[string]string{"main.yaml": "a: ${1A}\n"},
+			err:   "invalid variable name",
+		},
+		{
+			name:  "env unterminated",
+			files: map[string]string{"main.yaml": "a: ${T_SET\n"},
+			err:   "unterminated",
+		},
+		{
+			name: "secret",
+			files: map[string]string{
+				"main.yaml":     "include: conf.d\na: file:psk\nb: file:${T_SET}.psk\n",
+				"psk":           "s3cret\n",
+				"set.psk":       "other\r\n",
+				"conf.d/a.yaml": "c: file:psk\n",
+				"conf.d/psk":    "inner",
+			},
+			want: map[string]interface{}{"a": "s3cret", "b": "other", "c": "inner"},
+		},
+		{
+			name: "not a secret",
+			files: map[string]string{
+				"main.yaml": "a: $file:psk\nb: ${T_FILE}\nc: x file:psk\n",
+				"psk":       "s3cret",
+			},
+			want: map[string]interface{}{"a": "file:psk", "b": "file:psk", "c": "x file:psk"},
+		},
+		{
+			name:  "secret missing",
+			files: map[string]string{"main.yaml": "a: file:missing\n"},
+			err:   "main.yaml: line 1 column 4: a:",
+		},
+		{
+			name: "secret readable by others",
+			files: map[string]string{
+				"main.yaml": "a: file:psk\n",
+				"psk":       "s3cret",
+			},
+			modes: map[string]os.FileMode{"psk": 0644},
+			err:   "group and others must not access it",
+		},
+		{
+			name: "secret readable by the group",
+			files: map[string]string{
+				"main.yaml": "a: file:psk\n",
+				"psk":       "s3cret",
+			},
+			modes: map[string]os.FileMode{"psk": 0640},
+			err:   "group and others must not access it",
+		},
+	}
+	for _, tt := range tests {
+		if tt.modes != nil && runtime.GOOS == "windows" {
+			continue
+		}
+		dir := t.TempDir()
+		for name, content := range tt.files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			mode, ok := tt.modes[name]
+			if !ok {
+				mode = 0600
+			}
+			if err := os.WriteFile(path, []byte(content), mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tree, err := loadTree(filepath.Join(dir, "main.yaml"))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tree, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, tree, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.yaml")
+	data := "include: listeners.yaml\nadmin:\n  address: 127.0.0.1:9090\n"
+	if err := os.WriteFile(main, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	listeners := filepath.Join(dir, "listeners.yaml")
+	data = "config:\n  - address: 127.0.0.1\n    port: 70000\n    pipeline: [echo]\n"
+	if err := os.WriteFile(listeners, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(main, "")
+	want := "listeners.yaml: line 3 column 11: config[0].port"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,131 @@
+package mixed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var UnknownProtocol = errors.New("unknown protocol")
+
+// Config is the "mixed" inbound. It peeks at the first byte of a
+// connection to tell socks5, socks4, tls and http apart and hands the
+// stream to the chain configured for that protocol, the others are
+// refused. Without any chain socks5, socks4 and http are served by the
+// stage of the same name with an empty config, with no auth, so a chain
+// asking for users can not be gone around through another protocol.
+type Config struct {
+	Socks5 []interface{} `somersault:"socks5"`
+	Socks4 []interface{} `somersault:"socks4"`
+	HTTP   []interface{} `somersault:"http"`
+	TLS    []interface{} `somersault:"tls"`
+
+	once   sync.Once
+	chains map[string][]pipeline.Config
+	err    error
+}
+
+type Mixed struct {
+	*Config
+	pipeline.Pipeline
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{
+		Socks5: c.Socks5,
+		Socks4: c.Socks4,
+		HTTP:   c.HTTP,
+		TLS:    c.TLS,
+	}
+}
+
+func (c *Config) parse() error {
+	c.once.Do(func() {
+		c.chains = make(map[string][]pipeline.Config)
+		if c.Socks5 == nil && c.Socks4 == nil && c.HTTP == nil && c.TLS == nil {
+			for _, name := range []string{"socks5", "socks4", "http"} {
+				stage, err := pipeline.GetPipelineCreator(name, map[string]interface{}{})
+				if err != nil {
+					// not linked in, leave the protocol unsupported
+					continue
+				}
+				c.chains[name] = []pipeline.Config{stage}
+			}
+			return
+		}
+		for name, v := range map[string][]interface{}{
+			"socks5": c.Socks5,
+			"socks4": c.Socks4,
+			"http":   c.HTTP,
+			"tls":    c.TLS,
+		} {
+			if v == nil {
+				continue
+			}
+			chain, err := pipeline.ParseChain(v)
+			if err != nil {
+				c.err = pipeline.FieldError(name, err)
+				return
+			}
+			c.chains[name] = chain
+		}
+	})
+	return c.err
+}
+
+// Validate builds the chains, so errors show when the config is read.
+func (c *Config) Validate() error {
+	return c.parse()
+}
+
+func sniff(b byte) string {
+	switch {
+	case b == 0x05:
+		return "socks5"
+	case b == 0x04:
+		return "socks4"
+	case b == 0x16:
+		return "tls"
+	case b >= 'A' && b <= 'Z':
+		// every http method starts with an upper case letter
+		return "http"
+	}
+	return ""
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	err := c.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(input, buf)
+	if err != nil {
+		return nil, err
+	}
+	chain, ok := c.chains[sniff(buf[0])]
+	if !ok {
+		return nil, UnknownProtocol
+	}
+	p, err := pipeline.NewChain(ctx, chain, pipeline.NewReplay(buf, input))
+	if err != nil {
+		return nil, err
+	}
+	return &Mixed{c, p}, nil
+}
+
+func (m *Mixed) CloseWrite() error {
+	return pipeline.CloseWrite(m.Pipeline)
+}
+
+func init() {
+	config := &Config{}
+	pipeline.RegistePipelineCreator("mixed", config)
+}
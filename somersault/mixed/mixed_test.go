@@ -0,0 +1,96 @@
+package mixed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	_ "github.com/gchange/somersault/somersault/httpproxy"
+	"github.com/gchange/somersault/somersault/pipeline"
+	_ "github.com/gchange/somersault/somersault/socks4"
+	_ "github.com/gchange/somersault/somersault/socks5"
+)
+
+// conn reads the request in r and drops the replies.
+type conn struct {
+	r *bytes.Reader
+}
+
+func (c *conn) Read(buf []byte) (int, error)  { return c.r.Read(buf) }
+func (c *conn) Write(buf []byte) (int, error) { return len(buf), nil }
+func (c *conn) Close() error                  { return nil }
+
+func TestDefaultChains(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   []string
+	}{
+		{"none", map[string]interface{}{}, []string{"socks5", "socks4", "http"}},
+		{"socks5", map[string]interface{}{
+			"socks5": []interface{}{map[string]interface{}{"protocol": "socks5"}},
+		}, []string{"socks5"}},
+		{"tls", map[string]interface{}{
+			"tls": []interface{}{map[string]interface{}{"protocol": "socks5"}},
+		}, []string{"tls"}},
+	}
+	for _, tt := range tests {
+		c := &Config{}
+		err := pipeline.Decode(c, tt.config)
+		if err == nil {
+			err = c.Validate()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(c.chains) != len(tt.want) {
+			t.Errorf("%s: %d chains, want %v", tt.name, len(c.chains), tt.want)
+		}
+		for _, name := range tt.want {
+			if _, ok := c.chains[name]; !ok {
+				t.Errorf("%s: no %s chain", tt.name, name)
+			}
+		}
+	}
+}
+
+// TestUsersNotBypassed configures a socks5 chain with users only, a socks4
+// or http request must not get around them.
+func TestUsersNotBypassed(t *testing.T) {
+	c := &Config{}
+	err := pipeline.Decode(c, map[string]interface{}{
+		"socks5": []interface{}{map[string]interface{}{
+			"protocol": "socks5",
+			"config":   map[string]interface{}{"users": map[string]interface{}{"alice": "1234"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		request []byte
+	}{
+		{"socks4", []byte{0x04, 0x01, 0x00, 0x50, 93, 184, 216, 34, 0x00}},
+		{"http", []byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")},
+		{"socks5 no auth", []byte{0x05, 0x01, 0x00}},
+	}
+	for _, tt := range tests {
+		md := &pipeline.Metadata{}
+		ctx := pipeline.WithMetadata(context.Background(), md)
+		p, err := c.New(ctx, &conn{r: bytes.NewReader(tt.request)}, nil)
+		if err == nil {
+			p.Close()
+			t.Errorf("%s: accepted", tt.name)
+			continue
+		}
+		if tt.name != "socks5 no auth" && !errors.Is(err, UnknownProtocol) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, UnknownProtocol)
+		}
+		if md.User != "" {
+			t.Errorf("%s: user %q", tt.name, md.User)
+		}
+	}
+}
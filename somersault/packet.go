@@ -0,0 +1,229 @@
+package somersault
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxDatagramSize   = 65535
+	udpSessionTimeout = 2 * time.Minute
+	udpSessionBacklog = 64
+)
+
+// packetListener turns a udp socket into a net.Listener, every
+// (source, destination) pair seen on the socket is accepted as one
+// session so udp flows run through the same chains as tcp connections.
+type packetListener struct {
+	conn        *net.UDPConn
+	transparent bool
+	logger      *log.Logger
+	sessions    map[string]*packetSession
+	lock        sync.Mutex
+	accept      chan *packetSession
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+type packetSession struct {
+	listener *packetListener
+	key      string
+	local    *net.UDPAddr
+	remote   *net.UDPAddr
+	reply    *net.UDPConn
+	packets  chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	lock     sync.Mutex
+	deadline time.Time
+	// closed and replaced when the deadline changes
+	changed chan struct{}
+}
+
+func newPacketListener(conn *net.UDPConn, transparent bool, logger *log.Logger) *packetListener {
+	l := &packetListener{
+		conn:        conn,
+		transparent: transparent,
+		logger:      logger,
+		sessions:    make(map[string]*packetSession),
+		accept:      make(chan *packetSession),
+		closed:      make(chan struct{}),
+	}
+	go l.read()
+	return l
+}
+
+func (l *packetListener) read() {
+	defer l.Close()
+	buf := make([]byte, maxDatagramSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, from, err := l.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return
+		}
+		to, _ := l.conn.LocalAddr().(*net.UDPAddr)
+		if l.transparent {
+			if dst := parseOriginalDestination(oob[:oobn]); dst != nil {
+				to = dst
+			}
+		}
+
+		key := from.String() + "/" + to.String()
+		l.lock.Lock()
+		session, ok := l.sessions[key]
+		if !ok {
+			session, err = l.newSession(key, from, to)
+			if err != nil {
+				l.lock.Unlock()
+				l.logger.Println(err)
+				continue
+			}
+			l.sessions[key] = session
+		}
+		l.lock.Unlock()
+
+		if !ok {
+			select {
+			case l.accept <- session:
+			case <-l.closed:
+				return
+			}
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case session.packets <- packet:
+		default:
+			// drop it like a congested network would
+		}
+	}
+}
+
+func (l *packetListener) newSession(key string, from, to *net.UDPAddr) (*packetSession, error) {
+	session := &packetSession{
+		listener: l,
+		key:      key,
+		local:    to,
+		remote:   from,
+		packets:  make(chan []byte, udpSessionBacklog),
+		closed:   make(chan struct{}),
+		changed:  make(chan struct{}),
+	}
+	if l.transparent {
+		// replies have to come from the original destination
+		d := net.Dialer{
+			LocalAddr: to,
+			Control:   transparentReplyControl,
+		}
+		conn, err := d.Dial("udp", from.String())
+		if err != nil {
+			return nil, err
+		}
+		session.reply = conn.(*net.UDPConn)
+	}
+	return session, nil
+}
+
+func (l *packetListener) Accept() (net.Conn, error) {
+	select {
+	case session := <-l.accept:
+		return session, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *packetListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *packetListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (s *packetSession) Read(buf []byte) (int, error) {
+	idle := time.Now().Add(udpSessionTimeout)
+	for {
+		s.lock.Lock()
+		deadline := s.deadline
+		changed := s.changed
+		s.lock.Unlock()
+		if deadline.IsZero() {
+			deadline = idle
+		}
+		timer := time.NewTimer(time.Until(deadline))
+
+		select {
+		case packet := <-s.packets:
+			timer.Stop()
+			return copy(buf, packet), nil
+		case <-s.closed:
+			timer.Stop()
+			return 0, io.EOF
+		case <-s.listener.closed:
+			timer.Stop()
+			return 0, io.EOF
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+func (s *packetSession) Write(buf []byte) (int, error) {
+	if s.reply != nil {
+		return s.reply.Write(buf)
+	}
+	return s.listener.conn.WriteToUDP(buf, s.remote)
+}
+
+func (s *packetSession) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		s.listener.lock.Lock()
+		delete(s.listener.sessions, s.key)
+		s.listener.lock.Unlock()
+		if s.reply != nil {
+			err = s.reply.Close()
+		}
+	})
+	return err
+}
+
+func (s *packetSession) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *packetSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *packetSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *packetSession) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deadline = t
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+func (s *packetSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
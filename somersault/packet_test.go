@@ -0,0 +1,101 @@
+package somersault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// udpEcho sends every datagram back to where it came from.
+func udpEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+// TestPacketRelay relays the sessions of a udp listener to an echo server
+// with a buffer_size smaller than the datagrams, which must come back
+// whole, and checks every client gets a session of its own.
+func TestPacketRelay(t *testing.T) {
+	target := udpEcho(t)
+	defer target.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newPacketListener(conn, false, log.New(io.Discard, "", 0))
+	defer l.Close()
+
+	go func() {
+		for {
+			session, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("udp", target.LocalAddr().String())
+			if err != nil {
+				session.Close()
+				continue
+			}
+			md := &pipeline.Metadata{
+				BufferSize:  512,
+				Destination: &pipeline.Address{Network: "udp", Host: "127.0.0.1", Port: target.LocalAddr().(*net.UDPAddr).Port},
+			}
+			ctx := pipeline.WithMetadata(context.Background(), md)
+			dp, err := pipeline.NewDefaultPipeline(ctx, session, upstream)
+			if err != nil {
+				session.Close()
+				upstream.Close()
+				continue
+			}
+			go dp.Transport()
+		}
+	}()
+
+	for i, size := range []int{5, 4000} {
+		client, err := net.Dial("udp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		datagram := bytes.Repeat([]byte{byte('a' + i)}, size)
+		_, err = client.Write(datagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, maxDatagramSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Errorf("client %d: sent %d bytes, got %d back", i, size, n)
+		}
+	}
+
+	l.lock.Lock()
+	sessions := len(l.sessions)
+	l.lock.Unlock()
+	if sessions != 2 {
+		t.Errorf("%d sessions for 2 clients", sessions)
+	}
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// DefaultBufferSize is large enough to never truncate a datagram.
+const DefaultBufferSize = 65535
+
+var bufferPools sync.Map
+
+func getBuffer(size int) *[]byte {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	p, ok := bufferPools.Load(size)
+	if !ok {
+		p, _ = bufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	if p, ok := bufferPools.Load(len(*buf)); ok {
+		p.(*sync.Pool).Put(buf)
+	}
+}
+
+// NetConner is a wrapper adding nothing to the reads and writes of the
+// connection it returns, the relay may use that connection directly. Only
+// two tcp connections reached this way are spliced, a wrapper that sees the
+// bytes must not implement it: a metered connection counting the traffic of
+// a quota user, or a proxyproto.Conn holding what it read past the header,
+// always goes through copyBuffer.
+type NetConner interface {
+	NetConn() net.Conn
+}
+
+func tcpConn(p Pipeline) *net.TCPConn {
+	for {
+		switch c := p.(type) {
+		case *net.TCPConn:
+			return c
+		case NetConner:
+			p = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// splice copies between two tcp connections in the kernel, with splice(2)
+// on linux. It returns nil at EOF like io.Copy.
+func splice(dst, src *net.TCPConn) error {
+	_, err := dst.ReadFrom(src)
+	return err
+}
+
+// copyBuffer relays with a pooled buffer of size, touching idle on data.
+func copyBuffer(dst, src Pipeline, size int, touch func()) error {
+	buf := getBuffer(size)
+	defer putBuffer(buf)
+	for {
+		n, err := src.Read(*buf)
+		if n != 0 {
+			touch()
+			if err := writeFull(dst, (*buf)[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// opaqueConn hides the tcp connection under it, like a wrapper that does not
+// implement NetConner, so the relay falls back to copyBuffer.
+type opaqueConn struct {
+	net.Conn
+}
+
+func (c opaqueConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// baselineRelay is the copy loop Transport had before copyBuffer, it
+// allocates a buffer of 1024 bytes on every read.
+func baselineRelay(input, output Pipeline) {
+	var wg sync.WaitGroup
+	transport := func(reader, writer Pipeline) {
+		defer writer.Close()
+		defer wg.Done()
+		for {
+			buf := make([]byte, 1024)
+			n, err := reader.Read(buf)
+			if err != nil {
+				return
+			}
+			if n != 0 {
+				writer.Write(buf[:n])
+			}
+		}
+	}
+	wg.Add(2)
+	go transport(input, output)
+	go transport(output, input)
+	wg.Wait()
+}
+
+// transportRelay relays with Transport.
+func transportRelay(b *testing.B, wrap func(net.Conn) Pipeline) func(input, output net.Conn) {
+	return func(input, output net.Conn) {
+		dp, err := NewDefaultPipeline(context.Background(), wrap(input), wrap(output))
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		dp.Transport()
+	}
+}
+
+// BenchmarkTransport pushes data from a client through a relay between two
+// tcp connections into a sink, once spliced, once through copyBuffer and
+// once through the old copy loop as the baseline.
+func BenchmarkTransport(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkTransport(b, transportRelay(b, func(c net.Conn) Pipeline { return c }))
+	})
+	b.Run("copy", func(b *testing.B) {
+		benchmarkTransport(b, transportRelay(b, func(c net.Conn) Pipeline { return opaqueConn{c} }))
+	})
+	b.Run("baseline", func(b *testing.B) {
+		benchmarkTransport(b, func(input, output net.Conn) {
+			baselineRelay(opaqueConn{input}, opaqueConn{output})
+		})
+	})
+}
+
+func benchmarkTransport(b *testing.B, relay func(input, output net.Conn)) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	done := make(chan int64)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			close(done)
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close()
+		done <- n
+	}()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer front.Close()
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	input, err := front.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	output, err := net.Dial("tcp", sink.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	go relay(input, output)
+
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.(*net.TCPConn).CloseWrite()
+	if n := <-done; n != int64(b.N*len(chunk)) {
+		b.Fatalf("sink got %d bytes, want %d", n, b.N*len(chunk))
+	}
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var EmptyChain = errors.New("empty pipeline")
+
+// ParseChain builds the stages of a chain from its decoded json, a list of
+// {"protocol": name, "config": {...}} objects or URIs, see ExpandURI.
+// Stages that route connections use it for the chains they dispatch to.
+// Errors locate the stage like [1].config.port.
+func ParseChain(v interface{}) ([]Config, error) {
+	pcs, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("must be a list")
+	}
+	if len(pcs) == 0 {
+		return nil, EmptyChain
+	}
+
+	chain := make([]Config, 0, len(pcs))
+	for i, p := range pcs {
+		stages := []interface{}{p}
+		if s, ok := p.(string); ok {
+			var err error
+			stages, err = ExpandURI(s)
+			if err != nil {
+				return nil, FieldError(fmt.Sprintf("[%d]", i), err)
+			}
+		}
+		for _, stage := range stages {
+			c, err := parseStage(stage)
+			if err != nil {
+				return nil, FieldError(fmt.Sprintf("[%d]", i), err)
+			}
+			chain = append(chain, c)
+		}
+	}
+	return chain, nil
+}
+
+func parseStage(v interface{}) (Config, error) {
+	p, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("must be an object or a uri")
+	}
+	for key := range p {
+		if key != "protocol" && key != "config" {
+			return nil, FieldError(key, UnknownField)
+		}
+	}
+	protocol, ok := p["protocol"].(string)
+	if !ok || protocol == "" {
+		return nil, FieldError("protocol", Required)
+	}
+	config := map[string]interface{}{}
+	// a yaml config with every field commented out is null
+	if v, ok := p["config"]; ok && v != nil {
+		config, ok = v.(map[string]interface{})
+		if !ok {
+			return nil, FieldError("config", errors.New("must be an object"))
+		}
+	}
+	c, err := GetPipelineCreator(protocol, config)
+	if err == PipelineNotFound {
+		return nil, FieldError("protocol", fmt.Errorf("%s: %s", protocol, err))
+	} else if err != nil {
+		return nil, FieldError("config", err)
+	}
+	return c, nil
+}
+
+// NewChain runs input through every stage of chain and returns the
+// pipeline of the last one. No stage took input over when that is nil or
+// input itself, like for a chain of stages only setting the destination,
+// and closing it is up to the caller.
+func NewChain(ctx context.Context, chain []Config, input Pipeline) (Pipeline, error) {
+	var err error
+	for _, c := range chain {
+		input, err = c.New(ctx, input, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return input, nil
+}
@@ -0,0 +1,474 @@
+package pipeline
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textDurationType    = reflect.TypeOf(Duration(0))
+	sizeType            = reflect.TypeOf(Size(0))
+	ipNetType           = reflect.TypeOf(net.IPNet{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Decode sets the fields of the struct pointed to by nc from config and
+// validates it. A field is keyed by its somersault tag, by its name in
+// snake case without one, and "-" skips it. Options may follow the key,
+//
+//	Port  int    `somersault:"port,required"`
+//	Scope string `somersault:"scope,default=user,enum=user|source"`
+//
+// required refuses a config without the key, default is decoded when the
+// key is missing and the field still zero, and enum lists the values
+// allowed.
+//
+// Fields may be numbers, strings, bools, structs decoded from objects the
+// same way, slices, maps with string keys and pointers to any of them.
+// time.Duration and Duration take seconds or a string like "30s", Size
+// bytes or a string like "4MiB", net.IPNet a network or an address, and
+// types implementing encoding.TextUnmarshaler, like net.IP, a string. A
+// slice also takes a single value as a list of one. Types implementing
+// Decoder decode themselves.
+//
+// Keys without a field are refused and errors locate the value like
+// routes[1].port. Structs implementing Validator are validated once
+// decoded.
+func Decode(nc interface{}, config map[string]interface{}) error {
+	v := reflect.ValueOf(nc)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("can not decode into %T", nc)
+	}
+	return decodeStruct(v.Elem(), config)
+}
+
+// field is a field of a struct decoded from config.
+type field struct {
+	index      []int
+	key        string
+	required   bool
+	hasDefault bool
+	def        string
+	enum       []string
+}
+
+// structFields lists the fields of the struct type t, those of embedded
+// structs without a tag included.
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		tag := tf.Tag.Get("somersault")
+		if tag == "-" {
+			continue
+		}
+		if tf.Anonymous && tag == "" && tf.Type.Kind() == reflect.Struct {
+			for _, f := range structFields(tf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if tf.PkgPath != "" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		f := field{index: []int{i}, key: options[0]}
+		if f.key == "" {
+			f.key = snakeCase(tf.Name)
+		}
+		for _, option := range options[1:] {
+			switch {
+			case option == "required":
+				f.required = true
+			case strings.HasPrefix(option, "default="):
+				f.hasDefault = true
+				f.def = strings.TrimPrefix(option, "default=")
+			case strings.HasPrefix(option, "enum="):
+				f.enum = strings.Split(strings.TrimPrefix(option, "enum="), "|")
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// snakeCase turns a field name like ProxyProtocol or HTTPProxy into
+// proxy_protocol or http_proxy.
+func snakeCase(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func decodeStruct(v reflect.Value, config map[string]interface{}) error {
+	fields := structFields(v.Type())
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f.key] = true
+		fv := v.FieldByIndex(f.index)
+		val, ok := config[f.key]
+		switch {
+		case ok:
+		case f.required:
+			return FieldError(f.key, Required)
+		case f.hasDefault && fv.IsZero():
+			val = f.def
+		default:
+			continue
+		}
+		err := decodeValue(fv, val)
+		if err == nil && f.enum != nil {
+			err = checkEnum(fv, f.enum)
+		}
+		if err != nil {
+			return FieldError(f.key, err)
+		}
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] {
+			return FieldError(key, UnknownField)
+		}
+	}
+	if validator, ok := v.Addr().Interface().(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+func checkEnum(v reflect.Value, enum []string) error {
+	s := fmt.Sprint(v.Interface())
+	for _, e := range enum {
+		if s == e {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(enum, ", "))
+}
+
+func decodeValue(v reflect.Value, val interface{}) error {
+	if val == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if d, ok := v.Addr().Interface().(Decoder); ok {
+		return d.DecodeConfig(val)
+	}
+	m := reflect.ValueOf(val)
+	if m.Type().AssignableTo(v.Type()) {
+		v.Set(m)
+		return nil
+	}
+
+	switch v.Type() {
+	case durationType, textDurationType:
+		d, err := parseDuration(m)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case sizeType:
+		n, err := parseSize(m)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+		return nil
+	case ipNetType:
+		s, err := parseString(m)
+		if err != nil {
+			return err
+		}
+		n, err := ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(*n))
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		s, err := parseString(m)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		err := decodeValue(p.Elem(), val)
+		if err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Struct:
+		c, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected an object, got %s", kindName(m))
+		}
+		return decodeStruct(v, c)
+	case reflect.Slice:
+		list, ok := val.([]interface{})
+		if !ok {
+			list = []interface{}{val}
+		}
+		s := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, item := range list {
+			err := decodeValue(s.Index(i), item)
+			if err != nil {
+				return FieldError(fmt.Sprintf("[%d]", i), err)
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("can not decode into %s", v.Type())
+		}
+		c, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected an object, got %s", kindName(m))
+		}
+		mv := reflect.MakeMapWithSize(v.Type(), len(c))
+		for key, item := range c {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err := decodeValue(elem, item)
+			if err != nil {
+				return FieldError(key, err)
+			}
+			mv.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(mv)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := parseInt64(m)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%d out of range", n)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := parseUint64(m)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("%d out of range", n)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := parseFloat64(m)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, err := parseString(m)
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := parseBool(m)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("can not decode into %s", v.Type())
+	}
+	return nil
+}
+
+func kindName(val reflect.Value) string {
+	switch val.Kind() {
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	}
+	return val.Type().String()
+}
+
+func parseInt64(val reflect.Value) (int64, error) {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt64 {
+			return 0, fmt.Errorf("%d out of range", val.Uint())
+		}
+		return int64(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := val.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not an integer", f)
+		}
+		return int64(f), nil
+	case reflect.String:
+		n, err := strconv.ParseInt(strings.TrimSpace(val.String()), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer %q", val.String())
+		}
+		return n, nil
+	case reflect.Bool:
+		if val.Bool() {
+			return 1, nil
+		} else {
+			return 0, nil
+		}
+	default:
+		return 0, fmt.Errorf("expected a number, got %s", kindName(val))
+	}
+}
+
+func parseUint64(val reflect.Value) (uint64, error) {
+	n, err := parseInt64(val)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%d out of range", n)
+	}
+	return uint64(n), nil
+}
+
+func parseFloat64(val reflect.Value) (float64, error) {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), nil
+	case reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val.String()), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", val.String())
+		}
+		return f, nil
+	case reflect.Bool:
+		if val.Bool() {
+			return 1, nil
+		} else {
+			return 0, nil
+		}
+	default:
+		return 0, fmt.Errorf("expected a number, got %s", kindName(val))
+	}
+}
+
+func parseString(val reflect.Value) (string, error) {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(val.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(val.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(val.Float(), 'f', -1, 64), nil
+	case reflect.String:
+		return val.String(), nil
+	case reflect.Bool:
+		if val.Bool() {
+			return "true", nil
+		} else {
+			return "false", nil
+		}
+	default:
+		return "", fmt.Errorf("expected a string, got %s", kindName(val))
+	}
+}
+
+func parseBool(val reflect.Value) (bool, error) {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int() > 0, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return val.Uint() > 0, nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float() > 0, nil
+	case reflect.String:
+		b, err := strconv.ParseBool(strings.TrimSpace(val.String()))
+		if err != nil {
+			return false, fmt.Errorf("invalid bool %q", val.String())
+		}
+		return b, nil
+	case reflect.Bool:
+		return val.Bool(), nil
+	default:
+		return false, fmt.Errorf("expected a bool, got %s", kindName(val))
+	}
+}
+
+// parseDuration takes seconds or a string like "1m30s".
+func parseDuration(val reflect.Value) (time.Duration, error) {
+	var d time.Duration
+	if val.Kind() == reflect.String {
+		var err error
+		d, err = time.ParseDuration(strings.TrimSpace(val.String()))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", val.String())
+		}
+	} else {
+		seconds, err := parseFloat64(val)
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d < 0 {
+		return 0, errors.New("negative duration")
+	}
+	return d, nil
+}
+
+// parseSize takes bytes or a string like "4MiB".
+func parseSize(val reflect.Value) (int64, error) {
+	if val.Kind() == reflect.String {
+		return ParseSize(val.String())
+	}
+	n, err := parseInt64(val)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("negative size")
+	}
+	return n, nil
+}
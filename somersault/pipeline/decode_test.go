@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type decodeRoute struct {
+	Host string `somersault:"host,required"`
+	Port uint16
+}
+
+type decodeBase struct {
+	Name string `somersault:"name,default=base"`
+}
+
+type decodeConfig struct {
+	decodeBase
+	Mode     string            `somersault:"mode,default=user,enum=user|source"`
+	Timeout  time.Duration     `somersault:"timeout"`
+	Grace    Duration          `somersault:"grace"`
+	Buffer   Size              `somersault:"buffer"`
+	Allow    []net.IPNet       `somersault:"allow"`
+	IP       net.IP            `somersault:"ip"`
+	Routes   []decodeRoute     `somersault:"routes"`
+	Users    map[string]string `somersault:"users"`
+	Limit    *int              `somersault:"limit"`
+	Enabled  bool              `somersault:"enabled"`
+	Ratio    float64           `somersault:"ratio"`
+	Ignored  string            `somersault:"-"`
+	HTTPPort int
+	internal int
+}
+
+func (c *decodeConfig) Validate() error {
+	if c.Ratio > 1 {
+		return FieldError("ratio", errors.New("must be at most 1"))
+	}
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	limit := 3
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   *decodeConfig
+		err    string
+	}{
+		{
+			name:   "defaults",
+			config: map[string]interface{}{},
+			want:   &decodeConfig{decodeBase: decodeBase{Name: "base"}, Mode: "user"},
+		},
+		{
+			name: "all",
+			config: map[string]interface{}{
+				"name":      "n",
+				"mode":      "source",
+				"timeout":   "1m30s",
+				"grace":     2,
+				"buffer":    "4KiB",
+				"allow":     []interface{}{"10.0.0.0/8", "192.0.2.1"},
+				"ip":        "192.0.2.2",
+				"routes":    []interface{}{map[string]interface{}{"host": "h", "port": float64(80)}},
+				"users":     map[string]interface{}{"alice": "pw"},
+				"limit":     float64(3),
+				"enabled":   "true",
+				"ratio":     "0.5",
+				"http_port": "8080",
+			},
+			want: &decodeConfig{
+				decodeBase: decodeBase{Name: "n"},
+				Mode:       "source",
+				Timeout:    90 * time.Second,
+				Grace:      Duration(2 * time.Second),
+				Buffer:     4096,
+				Allow: []net.IPNet{
+					{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+					{IP: net.IPv4(192, 0, 2, 1).To4(), Mask: net.CIDRMask(32, 32)},
+				},
+				IP:       net.ParseIP("192.0.2.2"),
+				Routes:   []decodeRoute{{Host: "h", Port: 80}},
+				Users:    map[string]string{"alice": "pw"},
+				Limit:    &limit,
+				Enabled:  true,
+				Ratio:    0.5,
+				HTTPPort: 8080,
+			},
+		},
+		{
+			name:   "seconds and bytes",
+			config: map[string]interface{}{"timeout": 1.5, "buffer": 512},
+			want:   &decodeConfig{decodeBase: decodeBase{Name: "base"}, Mode: "user", Timeout: 1500 * time.Millisecond, Buffer: 512},
+		},
+		{
+			name:   "single value as list",
+			config: map[string]interface{}{"routes": map[string]interface{}{"host": "h"}},
+			want:   &decodeConfig{decodeBase: decodeBase{Name: "base"}, Mode: "user", Routes: []decodeRoute{{Host: "h"}}},
+		},
+		{name: "unknown field", config: map[string]interface{}{"hots": "h"}, err: "hots: unknown field"},
+		{name: "skipped field", config: map[string]interface{}{"ignored": "x"}, err: "ignored: unknown field"},
+		{name: "unexported field", config: map[string]interface{}{"internal": 1}, err: "internal: unknown field"},
+		{name: "enum", config: map[string]interface{}{"mode": "group"}, err: "mode: must be one of user, source"},
+		{
+			name:   "required in list",
+			config: map[string]interface{}{"routes": []interface{}{map[string]interface{}{"host": "h"}, map[string]interface{}{"port": 1}}},
+			err:    "routes[1].host: required",
+		},
+		{
+			name:   "unknown in list",
+			config: map[string]interface{}{"routes": []interface{}{map[string]interface{}{"host": "h", "ports": 1}}},
+			err:    "routes[0].ports: unknown field",
+		},
+		{
+			name:   "out of range",
+			config: map[string]interface{}{"routes": []interface{}{map[string]interface{}{"host": "h", "port": 70000}}},
+			err:    "routes[0].port: 70000 out of range",
+		},
+		{name: "negative duration", config: map[string]interface{}{"timeout": "-1s"}, err: "timeout: negative duration"},
+		{name: "invalid duration", config: map[string]interface{}{"timeout": "soon"}, err: `timeout: invalid duration "soon"`},
+		{name: "invalid size", config: map[string]interface{}{"buffer": "4XB"}, err: `buffer: invalid size "4XB"`},
+		{name: "fraction", config: map[string]interface{}{"limit": 1.5}, err: "limit: 1.5 is not an integer"},
+		{name: "object for string", config: map[string]interface{}{"name": map[string]interface{}{}}, err: "name: expected a string, got an object"},
+		{name: "list for object", config: map[string]interface{}{"users": []interface{}{"a"}}, err: "users: expected an object, got a list"},
+		{name: "invalid network", config: map[string]interface{}{"allow": []interface{}{"10.0.0.0/8", "nope"}}, err: "allow[1]: "},
+		{name: "invalid ip", config: map[string]interface{}{"ip": "nope"}, err: "ip: "},
+		{name: "invalid bool", config: map[string]interface{}{"enabled": "maybe"}, err: `enabled: invalid bool "maybe"`},
+		{name: "validate", config: map[string]interface{}{"ratio": 2}, err: "ratio: must be at most 1"},
+	}
+	for _, tt := range tests {
+		c := &decodeConfig{}
+		err := Decode(c, tt.config)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("%s:\n%+v\nwant\n%+v", tt.name, c, tt.want)
+		}
+	}
+}
+
+func TestDecodeTarget(t *testing.T) {
+	var c decodeConfig
+	if err := Decode(c, nil); err == nil {
+		t.Error("decoded into a struct value")
+	}
+	var n int
+	if err := Decode(&n, nil); err == nil {
+		t.Error("decoded into an int")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{" 64KB ", 64000, true},
+		{"4MiB", 4 << 20, true},
+		{"1.5K", 1536, true},
+		{"2 GiB", 2 << 30, true},
+		{"10B", 10, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"-1K", 0, false},
+		{"4XB", 0, false},
+		{"MiB", 0, false},
+	}
+	for _, tt := range tests {
+		n, err := ParseSize(tt.s)
+		if (err == nil) != tt.ok || n != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.s, n, err, tt.want)
+		}
+	}
+}
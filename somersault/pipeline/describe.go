@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// FieldInfo describes a field of a stage config, see Describe.
+type FieldInfo struct {
+	Key      string
+	Type     string
+	Required bool
+	// Default is the default option of the field, else its value in the
+	// registered config when it is set.
+	Default string
+	Enum    []string
+	// Fields of an object, or of the items of a list of objects.
+	Fields []FieldInfo
+}
+
+// PipelineNames lists the registered stages, sorted.
+func PipelineNames() []string {
+	pipelineLock.RLock()
+	defer pipelineLock.RUnlock()
+	names := make([]string, 0, len(pipelineCreatorMap))
+	for name := range pipelineCreatorMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DescribePipeline describes the config of the stage registered as name.
+func DescribePipeline(name string) ([]FieldInfo, error) {
+	pipelineLock.RLock()
+	c, ok := pipelineCreatorMap[name]
+	pipelineLock.RUnlock()
+	if !ok {
+		return nil, PipelineNotFound
+	}
+	return Describe(c), nil
+}
+
+// Describe lists the fields Decode sets in the struct pointed to by nc.
+func Describe(nc interface{}) []FieldInfo {
+	v := reflect.ValueOf(nc)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	return describeStruct(v.Elem())
+}
+
+func describeStruct(v reflect.Value) []FieldInfo {
+	fields := structFields(v.Type())
+	infos := make([]FieldInfo, len(fields))
+	for i, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		info := FieldInfo{
+			Key:      f.key,
+			Type:     typeName(fv.Type()),
+			Required: f.required,
+			Default:  f.def,
+			Enum:     f.enum,
+		}
+		if !f.hasDefault && !fv.IsZero() {
+			info.Default = formatDefault(fv)
+		}
+		t := fv.Type()
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct && typeName(t) == "object" {
+			info.Fields = describeStruct(reflect.New(t).Elem())
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// typeName names t the way a config writer thinks of it.
+func typeName(t reflect.Type) string {
+	switch t {
+	case durationType, textDurationType:
+		return "duration"
+	case sizeType:
+		return "size"
+	case ipNetType:
+		return "network"
+	}
+	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeName(t.Elem())
+	case reflect.Struct:
+		return "object"
+	case reflect.Slice:
+		return "list of " + typeName(t.Elem()) + "s"
+	case reflect.Map:
+		return "map"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	}
+	return "value"
+}
+
+// formatDefault formats the value of a field set in a registered config,
+// leaving out lists and objects.
+func formatDefault(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Map, reflect.Interface:
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
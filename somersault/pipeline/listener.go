@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	listenerCreatorMap = make(map[string]ListenerConfig)
+	listenerLock       = sync.RWMutex{}
+
+	ListenerNotFound = errors.New("listener creator not found")
+)
+
+// ListenerConfig creates listeners for a network net.Listen does not know,
+// the connections they accept run through the chain of their entry like
+// any other.
+type ListenerConfig interface {
+	Listen(ctx context.Context, address string, port int) (net.Listener, error)
+	DeepCopy() ListenerConfig
+}
+
+func RegisteListenerCreator(network string, config ListenerConfig) error {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	if _, ok := listenerCreatorMap[network]; ok {
+		return fmt.Errorf("duplicate listener named %s", network)
+	}
+	listenerCreatorMap[network] = config
+	return nil
+}
+
+// GetListenerCreator decodes the listener entry into a copy of the config
+// registered for network.
+func GetListenerCreator(network string, config map[string]interface{}) (ListenerConfig, error) {
+	listenerLock.RLock()
+	c, ok := listenerCreatorMap[network]
+	listenerLock.RUnlock()
+	if !ok {
+		return nil, ListenerNotFound
+	}
+	nc := c.DeepCopy()
+	err := Decode(nc, config)
+	if err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
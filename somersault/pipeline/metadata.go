@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metadataKey struct{}
+
+type loggerKey struct{}
+
+type groupKey struct{}
+
+// Address is an endpoint a connection is destined to.
+type Address struct {
+	Network string
+	Host    string
+	Port    int
+	// Pinned is a destination the config chose, like that of a forward
+	// stage, the client had no say in it and the destination policy does
+	// not apply.
+	Pinned bool
+}
+
+func (a *Address) String() string {
+	if strings.HasPrefix(a.Network, "unix") {
+		// Host is the socket path
+		return a.Host
+	}
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// Metadata is shared by all the stages of a chain serving one connection.
+// Inbound stages fill it in, outbound stages read it to decide where to go.
+type Metadata struct {
+	Listener net.Addr
+	// Source is the client, Local the address it connected to. Both come
+	// from the PROXY header on listeners behind a load balancer.
+	Source      net.Addr
+	Local       net.Addr
+	Destination *Address
+	// User is set once a stage authenticated the client.
+	User string
+	// Policy limits where Dial may go, the default one when nil.
+	Policy   *DestinationPolicy
+	Timeouts Timeouts
+	// BufferSize of the relay, DefaultBufferSize when zero. Udp relays
+	// use at least DefaultBufferSize to read whole datagrams.
+	BufferSize int
+	// Serve runs the connections accepted on a listener a stage opened,
+	// like the bind address of a reverse tunnel, through chain the way the
+	// listener of this connection runs its own, acl, limits and quota
+	// included. It stops with l. Nil outside a server.
+	Serve func(l net.Listener, chain []Config) error
+
+	userHooks []func(string) error
+}
+
+func WithMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+func GetMetadata(ctx context.Context) *Metadata {
+	md, _ := ctx.Value(metadataKey{}).(*Metadata)
+	return md
+}
+
+// WithLogger gives the stages and listeners created under ctx the logger
+// of the server.
+func WithLogger(ctx context.Context, logger *log.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger of ctx, the standard one without.
+func Logger(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Logger); ok {
+		return logger
+	}
+	return log.Default()
+}
+
+// WithGroup counts the goroutines stages start with Go under ctx in wg, so
+// the server can wait for them on close.
+func WithGroup(ctx context.Context, wg *sync.WaitGroup) context.Context {
+	return context.WithValue(ctx, groupKey{}, wg)
+}
+
+// Go runs f in a goroutine counted by the group of ctx, stages start their
+// relays with it.
+func Go(ctx context.Context, f func()) {
+	wg, _ := ctx.Value(groupKey{}).(*sync.WaitGroup)
+	if wg == nil {
+		go f()
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+}
+
+// OnUser registers f to run when a stage authenticates the client, f may
+// refuse the user.
+func (md *Metadata) OnUser(f func(string) error) {
+	md.userHooks = append(md.userHooks, f)
+}
+
+// SetUser records the authenticated user unless a hook refuses it.
+func (md *Metadata) SetUser(user string) error {
+	for _, f := range md.userHooks {
+		if err := f(user); err != nil {
+			return err
+		}
+	}
+	md.User = user
+	return nil
+}
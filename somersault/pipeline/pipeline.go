@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"reflect"
-	"strconv"
 	"strings"
 	"sync"
 )
@@ -14,6 +12,10 @@ import (
 var (
 	pipelineCreatorMap = make(map[string]Config)
 	pipelineLock       = sync.RWMutex{}
+
+	PipelineNotFound = errors.New("pipeline creator not found")
+	UnknownField     = errors.New("unknown field")
+	Required         = errors.New("required")
 )
 
 type Error struct {
@@ -39,6 +41,49 @@ func (e *Error) Append(err error) {
 	e.errs = append(e.errs, err)
 }
 
+// ConfigError is an invalid value of the config at Path, like
+// config[2].pipeline[0].config.port.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError places err under field, "name" or "[index]", in front of the
+// path err may already have.
+func FieldError(field string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ce, ok := err.(*ConfigError); ok {
+		if strings.HasPrefix(ce.Path, "[") {
+			return &ConfigError{Path: field + ce.Path, Err: ce.Err}
+		}
+		return &ConfigError{Path: field + "." + ce.Path, Err: ce.Err}
+	}
+	return &ConfigError{Path: field, Err: err}
+}
+
+// Validator is a config checking its values once decoded, errors name the
+// offending field with FieldError.
+type Validator interface {
+	Validate() error
+}
+
+// Decoder is a value decoding itself from its value in a config, like a
+// listener written either as a URI or as an object. Errors locate the
+// offending value with FieldError.
+type Decoder interface {
+	DecodeConfig(val interface{}) error
+}
+
 type Config interface {
 	New(ctx context.Context, input, output Pipeline) (Pipeline, error)
 	DeepCopy() Config
@@ -50,6 +95,37 @@ type Pipeline interface {
 	Close() error
 }
 
+// CloseWriter is a pipeline able to shut down its write side alone, like
+// *net.TCPConn. Wrappers forward it to what they wrap.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+var CloseWriteUnsupported = errors.New("close write not supported")
+
+// CloseWrite half closes p if it supports it.
+func CloseWrite(p interface{}) error {
+	if cw, ok := p.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return CloseWriteUnsupported
+}
+
+// writeFull writes all of buf, w may take it in several writes.
+func writeFull(w Pipeline, buf []byte) error {
+	for len(buf) != 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
 type DefaultPipeline struct {
 	input  Pipeline
 	output Pipeline
@@ -92,32 +168,58 @@ func (dp *DefaultPipeline) Write(buf []byte) (int, error) {
 	return dp.input.Write(buf)
 }
 
+// CloseWrite half closes the input, the side Write goes to.
+func (dp *DefaultPipeline) CloseWrite() error {
+	if dp.input == nil {
+		return CloseWriteUnsupported
+	}
+	return CloseWrite(dp.input)
+}
+
 func (dp *DefaultPipeline) Transport() {
 	defer dp.Close()
 	if dp.input == nil || dp.output == nil {
 		return
 	}
 
+	timeouts := getTimeouts(dp.ctx)
+	idle := newIdleTimer(timeouts, func() { dp.Close() })
+	defer idle.stop()
+	bufferSize := 0
+	if md := GetMetadata(dp.ctx); md != nil {
+		bufferSize = md.BufferSize
+		// a read shorter than a datagram truncates it
+		if md.Destination != nil && strings.HasPrefix(md.Destination.Network, "udp") && bufferSize < DefaultBufferSize {
+			bufferSize = DefaultBufferSize
+		}
+	}
+
 	wg := sync.WaitGroup{}
-	transport := func(reader Pipeline, writer Pipeline) {
-		defer writer.Close()
+	transport := func(reader Pipeline, writer Pipeline, upload bool) {
 		defer wg.Done()
-		for {
-			buf := make([]byte, 1024)
-			n, err := reader.Read(buf)
-			if err != nil {
-				fmt.Println(reader, writer, err)
-				return
-			}
-			if n != 0 {
-				writer.Write(buf[:n])
-			}
+		var err error
+		src, dst := tcpConn(reader), tcpConn(writer)
+		if src != nil && dst != nil && !idle.watches(upload) {
+			// nothing in between, let the kernel move the data
+			err = splice(dst, src)
+		} else {
+			err = copyBuffer(writer, reader, bufferSize, func() { idle.touch(upload) })
+		}
+		if err != nil {
+			Logger(dp.ctx).Printf("relay: %s\n", err)
+			dp.Close()
+			return
+		}
+		// pass the half close on and let the other direction finish, or
+		// close when the writer can not half close
+		if CloseWrite(writer) != nil {
+			writer.Close()
 		}
 	}
 
 	wg.Add(2)
-	go transport(dp.input, dp.output)
-	go transport(dp.output, dp.input)
+	go transport(dp.input, dp.output, true)
+	go transport(dp.output, dp.input, false)
 	wg.Wait()
 	fmt.Println("stop transport")
 }
@@ -150,173 +252,18 @@ func RegistePipelineCreator(name string, config Config) error {
 	return nil
 }
 
-func parseInt64(val reflect.Value) (int64, error) {
-	switch val.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return val.Int(), nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return int64(val.Uint()), nil
-	case reflect.Float32, reflect.Float64:
-		return int64(val.Float()), nil
-	case reflect.String:
-		return strconv.ParseInt(val.String(), 10, 64)
-	case reflect.Bool:
-		if val.Bool() {
-			return 1, nil
-		} else {
-			return 0, nil
-		}
-	default:
-		return 0, errors.New("syntax error")
-	}
-}
-
-func parseUint64(val reflect.Value) (uint64, error) {
-	switch val.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return uint64(val.Int()), nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return val.Uint(), nil
-	case reflect.Float32, reflect.Float64:
-		return uint64(val.Float()), nil
-	case reflect.String:
-		return strconv.ParseUint(val.String(), 10, 64)
-	case reflect.Bool:
-		if val.Bool() {
-			return 1, nil
-		} else {
-			return 0, nil
-		}
-	default:
-		return 0, errors.New("syntax error")
-	}
-}
-
-func parseFloat64(val reflect.Value) (float64, error) {
-	switch val.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return float64(val.Int()), nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return float64(val.Uint()), nil
-	case reflect.Float32, reflect.Float64:
-		return val.Float(), nil
-	case reflect.String:
-		return strconv.ParseFloat(val.String(), 64)
-	case reflect.Bool:
-		if val.Bool() {
-			return 1, nil
-		} else {
-			return 0, nil
-		}
-	default:
-		return 0, errors.New("syntax error")
-	}
-}
-
-func parseString(val reflect.Value) (string, error) {
-	switch val.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return strconv.FormatInt(val.Int(), 10), nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return strconv.FormatUint(val.Uint(), 10), nil
-	case reflect.Float32, reflect.Float64:
-		return strconv.FormatFloat(val.Float(), 'f', 6, 64), nil
-	case reflect.String:
-		return val.String(), nil
-	case reflect.Bool:
-		if val.Bool() {
-			return "true", nil
-		} else {
-			return "false", nil
-		}
-	default:
-		return "", errors.New("syntax error")
-	}
-}
-
-func parseBool(val reflect.Value) (bool, error) {
-	switch val.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return val.Int() > 0, nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return val.Uint() > 0, nil
-	case reflect.Float32, reflect.Float64:
-		return val.Float() > 0, nil
-	case reflect.String:
-		return val.String() == "", nil
-	case reflect.Bool:
-		return val.Bool(), nil
-	default:
-		return false, errors.New("syntax error")
-	}
-}
-
 func GetPipelineCreator(name string, config map[string]interface{}) (Config, error) {
 	pipelineLock.RLock()
-	defer pipelineLock.RUnlock()
-	fmt.Println("pipeconfig", config)
-	if c, ok := pipelineCreatorMap[name]; ok {
-		nc := c.DeepCopy()
-		v := reflect.Indirect(reflect.ValueOf(nc))
-		t := v.Type()
-		for i := 0; i < v.NumField(); i++ {
-			tf := t.Field(i)
-			vf := v.Field(i)
-			if !vf.CanSet() {
-				continue
-			}
-
-			key := ""
-			if tag := tf.Tag.Get("somersault"); tag != "" {
-				key = tag
-			} else {
-				key = strings.ToLower(t.Name())
-			}
-
-			if val, ok := config[key]; ok {
-				m := reflect.ValueOf(val)
-				if m.Kind() == vf.Kind() {
-					vf.Set(m)
-					continue
-				}
-
-				switch vf.Kind() {
-				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-					mv, err := parseInt64(m)
-					if err != nil {
-						return nil, err
-					}
-					vf.SetInt(mv)
-				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-					mv, err := parseUint64(m)
-					if err != nil {
-						return nil, err
-					}
-					vf.SetUint(mv)
-				case reflect.Float32, reflect.Float64:
-					mv, err := parseFloat64(m)
-					if err != nil {
-						return nil, err
-					}
-					vf.SetFloat(mv)
-				case reflect.String:
-					mv, err := parseString(m)
-					if err != nil {
-						return nil, err
-					}
-					vf.SetString(mv)
-				case reflect.Bool:
-					mv, err := parseBool(m)
-					if err != nil {
-						return nil, err
-					}
-					vf.SetBool(mv)
-				default:
-					return nil, errors.New("wrong type config")
-				}
-			}
-		}
-		return nc, nil
+	c, ok := pipelineCreatorMap[name]
+	pipelineLock.RUnlock()
+	if !ok {
+		return nil, PipelineNotFound
+	}
+	// stages may look up the stages of their own chains while decoding
+	nc := c.DeepCopy()
+	err := Decode(nc, config)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("parser creator not found")
+	return nc, nil
 }
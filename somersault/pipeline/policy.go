@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var DestinationForbidden = errors.New("destination not allowed")
+
+// internalNetworks are refused unless a listener allows them: this host,
+// private and shared address space, link local including the cloud
+// metadata endpoints, and multicast.
+var internalNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// DefaultDestinationPolicy applies to connections without a policy of
+// their own.
+var DefaultDestinationPolicy = &DestinationPolicy{}
+
+// DestinationPolicy decides which addresses the destinations clients ask
+// for may resolve to. Deny wins over Allow, Allow over the internal
+// networks refused by default.
+type DestinationPolicy struct {
+	Allow         []*net.IPNet
+	Deny          []*net.IPNet
+	AllowInternal bool
+}
+
+// ParseCIDR parses a network, or a single address as a host network.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		} else {
+			ip = ip.To4()
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func mustParseCIDRs(list ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(list))
+	for i, s := range list {
+		n, err := ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DestinationPolicy) Permit(ip net.IP) bool {
+	if containsIP(p.Deny, ip) {
+		return false
+	}
+	if containsIP(p.Allow, ip) {
+		return true
+	}
+	return p.AllowInternal || !containsIP(internalNetworks, ip)
+}
+
+// Dial connects to address, a destination asked for by the client, on
+// behalf of the stage serving ctx. The host is resolved first and only the
+// addresses the policy of the connection permits are dialed, so a name
+// pointing into the internal networks is refused like the address itself.
+func Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	policy := DefaultDestinationPolicy
+	if md := GetMetadata(ctx); md != nil && md.Policy != nil {
+		policy = md.Policy
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	d := Dialer(ctx)
+	err = DestinationForbidden
+	for _, addr := range addrs {
+		if !policy.Permit(addr.IP) {
+			continue
+		}
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == DestinationForbidden {
+		return nil, fmt.Errorf("%s: %w", address, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestPermit(t *testing.T) {
+	allowNet := mustParseCIDRs("10.1.0.0/16")
+	denyNet := mustParseCIDRs("10.1.2.0/24", "203.0.113.0/24")
+	tests := []struct {
+		ip     string
+		policy *DestinationPolicy
+		want   bool
+	}{
+		{"93.184.216.34", DefaultDestinationPolicy, true},
+		{"2606:2800:220:1::1", DefaultDestinationPolicy, true},
+		{"127.0.0.1", DefaultDestinationPolicy, false},
+		{"::1", DefaultDestinationPolicy, false},
+		{"10.0.0.1", DefaultDestinationPolicy, false},
+		{"172.16.5.4", DefaultDestinationPolicy, false},
+		{"192.168.1.1", DefaultDestinationPolicy, false},
+		{"100.64.0.1", DefaultDestinationPolicy, false},
+		{"169.254.169.254", DefaultDestinationPolicy, false},
+		{"fe80::1", DefaultDestinationPolicy, false},
+		{"fd00::1", DefaultDestinationPolicy, false},
+		{"224.0.0.1", DefaultDestinationPolicy, false},
+		{"0.0.0.0", DefaultDestinationPolicy, false},
+		{"::", DefaultDestinationPolicy, false},
+		{"::ffff:127.0.0.1", DefaultDestinationPolicy, false},
+		{"10.1.3.4", &DestinationPolicy{Allow: allowNet}, true},
+		{"10.2.3.4", &DestinationPolicy{Allow: allowNet}, false},
+		{"10.1.2.3", &DestinationPolicy{Allow: allowNet, Deny: denyNet}, false},
+		{"203.0.113.9", &DestinationPolicy{Deny: denyNet}, false},
+		{"127.0.0.1", &DestinationPolicy{AllowInternal: true}, true},
+		{"10.1.2.3", &DestinationPolicy{Deny: denyNet, AllowInternal: true}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Permit(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Permit(%s) with %+v = %v, want %v", tt.ip, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestDialInternal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		_, err := Dial(context.Background(), "tcp", net.JoinHostPort(host, port))
+		if !errors.Is(err, DestinationForbidden) {
+			t.Errorf("%s: error %v, want %v", host, err, DestinationForbidden)
+		}
+	}
+
+	md := &Metadata{Policy: &DestinationPolicy{AllowInternal: true}}
+	conn, err := Dial(WithMetadata(context.Background(), md), "tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
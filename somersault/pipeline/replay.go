@@ -0,0 +1,28 @@
+package pipeline
+
+// Replay hands out bytes a stage already consumed from a pipeline before
+// reading from it again, so peeking stages can pass the stream on intact.
+type Replay struct {
+	Pipeline
+	buf []byte
+}
+
+func NewReplay(buf []byte, input Pipeline) *Replay {
+	return &Replay{
+		Pipeline: input,
+		buf:      buf,
+	}
+}
+
+func (r *Replay) Read(buf []byte) (int, error) {
+	if len(r.buf) != 0 {
+		n := copy(buf, r.buf)
+		r.buf = r.buf[n:]
+		return n, nil
+	}
+	return r.Pipeline.Read(buf)
+}
+
+func (r *Replay) CloseWrite() error {
+	return CloseWrite(r.Pipeline)
+}
@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts of a connection, zero disables one.
+type Timeouts struct {
+	// Handshake bounds the setup of the chain, until every stage is
+	// ready to relay.
+	Handshake time.Duration
+	// Idle closes the connection when neither direction carried data for
+	// that long, UploadIdle and DownloadIdle when only one did not.
+	Idle         time.Duration
+	UploadIdle   time.Duration
+	DownloadIdle time.Duration
+	// Dial bounds the connection to an outbound.
+	Dial time.Duration
+	// Lifetime closes the connection however busy it is.
+	Lifetime time.Duration
+}
+
+func getTimeouts(ctx context.Context) Timeouts {
+	if md := GetMetadata(ctx); md != nil {
+		return md.Timeouts
+	}
+	return Timeouts{}
+}
+
+// Dialer returns a dialer honoring the dial timeout of ctx.
+func Dialer(ctx context.Context) *net.Dialer {
+	return &net.Dialer{Timeout: getTimeouts(ctx).Dial}
+}
+
+// idleTimer runs f once none of its directions were touched for their
+// timeouts.
+type idleTimer struct {
+	lock   sync.Mutex
+	timers []*time.Timer
+	// timers touched by each direction, by index
+	upload, download []int
+	durations        []time.Duration
+}
+
+func newIdleTimer(t Timeouts, f func()) *idleTimer {
+	it := &idleTimer{}
+	add := func(d time.Duration, upload, download bool) {
+		if d <= 0 {
+			return
+		}
+		i := len(it.timers)
+		it.timers = append(it.timers, time.AfterFunc(d, f))
+		it.durations = append(it.durations, d)
+		if upload {
+			it.upload = append(it.upload, i)
+		}
+		if download {
+			it.download = append(it.download, i)
+		}
+	}
+	add(t.Idle, true, true)
+	add(t.UploadIdle, true, false)
+	add(t.DownloadIdle, false, true)
+	return it
+}
+
+func (it *idleTimer) touch(upload bool) {
+	list := it.download
+	if upload {
+		list = it.upload
+	}
+	if len(list) == 0 {
+		return
+	}
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	for _, i := range list {
+		it.timers[i].Reset(it.durations[i])
+	}
+}
+
+// watches tells whether a direction has to touch the timer.
+func (it *idleTimer) watches(upload bool) bool {
+	if upload {
+		return len(it.upload) != 0
+	}
+	return len(it.download) != 0
+}
+
+func (it *idleTimer) stop() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	for _, t := range it.timers {
+		t.Stop()
+	}
+}
@@ -0,0 +1,266 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	v1MaxLength   = 107
+	headerTimeout = 5 * time.Second
+
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamUnspec = 0x00
+	v2FamTCP4   = 0x11
+	v2FamUDP4   = 0x12
+	v2FamTCP6   = 0x21
+	v2FamUDP6   = 0x22
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	InvalidHeader      = errors.New("invalid proxy protocol header")
+	UnsupportedVersion = errors.New("unsupported proxy protocol version")
+)
+
+// Conn is an accepted connection whose addresses come from the PROXY
+// header sent by the load balancer in front of us. Reads go through the
+// buffer the header was read with, so it is no pipeline.NetConner and its
+// connections are never spliced.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	source net.Addr
+	local  net.Addr
+}
+
+// Accept reads the PROXY header, v1 or v2, from a freshly accepted
+// connection. Connections without a header are refused.
+func Accept(conn net.Conn) (*Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	source, local, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		Conn:   conn,
+		reader: reader,
+		source: source,
+		local:  local,
+	}
+	if c.source == nil {
+		c.source = conn.RemoteAddr()
+	}
+	if c.local == nil {
+		c.local = conn.LocalAddr()
+	}
+	return c, nil
+}
+
+func (c *Conn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
+}
+
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.New("not a socket")
+}
+
+// ReadHeader returns the source and destination carried by a PROXY header.
+// Both are nil for v1 UNKNOWN and v2 LOCAL headers.
+func ReadHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := reader.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(sig, v2Signature) {
+		return readV2(reader)
+	}
+	sig, err = reader.Peek(len(v1Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, v1Signature) {
+		return readV1(reader)
+	}
+	return nil, nil, InvalidHeader
+}
+
+func readV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, nil, InvalidHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, InvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, InvalidHeader
+	}
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, nil, InvalidHeader
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, nil, InvalidHeader
+	}
+	if srcIP == nil || dstIP == nil {
+		return nil, nil, InvalidHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, UnsupportedVersion
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] {
+	case v2CmdLocal:
+		return nil, nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, nil, InvalidHeader
+	}
+
+	var ipLen int
+	switch header[13] {
+	case v2FamTCP4, v2FamUDP4:
+		ipLen = net.IPv4len
+	case v2FamTCP6, v2FamUDP6:
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry nothing usable
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, InvalidHeader
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	if header[13]&0x0f == 0x02 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+func splitAddr(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+// WriteHeader sends a version 1 or 2 header describing source and
+// destination. Addresses that cannot be expressed produce an UNKNOWN or
+// LOCAL header.
+func WriteHeader(w io.Writer, version int, source, destination net.Addr) error {
+	srcIP, srcPort, udp := splitAddr(source)
+	dstIP, dstPort, _ := splitAddr(destination)
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	known := srcIP != nil && dstIP != nil && (ipv4 || (srcIP.To4() == nil && dstIP.To4() == nil))
+
+	switch version {
+	case 1:
+		var line string
+		if !known || udp {
+			line = "PROXY UNKNOWN\r\n"
+		} else if ipv4 {
+			line = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort)
+		} else {
+			line = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort)
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	case 2:
+		buf := append([]byte{}, v2Signature...)
+		if !known {
+			buf = append(buf, v2CmdLocal, v2FamUnspec, 0, 0)
+			_, err := w.Write(buf)
+			return err
+		}
+		var fam byte
+		if ipv4 {
+			fam = v2FamTCP4
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		} else {
+			fam = v2FamTCP6
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+		if udp {
+			fam++
+		}
+		buf = append(buf, v2CmdProxy, fam)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(2*len(srcIP)+4))
+		buf = append(buf, srcIP...)
+		buf = append(buf, dstIP...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(srcPort))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(dstPort))
+		_, err := w.Write(buf)
+		return err
+	}
+	return UnsupportedVersion
+}
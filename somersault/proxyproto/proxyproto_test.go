@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func v2Header(cmd, fam byte, body []byte) []byte {
+	buf := append([]byte{}, v2Signature...)
+	buf = append(buf, cmd, fam)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(body)))
+	return append(buf, body...)
+}
+
+func TestReadHeader(t *testing.T) {
+	tcp4 := append(net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()...)
+	tcp4 = binary.BigEndian.AppendUint16(tcp4, 1234)
+	tcp4 = binary.BigEndian.AppendUint16(tcp4, 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		source string
+		local  string
+		err    error
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\n"), "192.0.2.1:5000", "192.0.2.2:80", nil},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n"), "[2001:db8::1]:5000", "[2001:db8::2]:80", nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", nil},
+		{"v1 without crlf", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\n"), "", "", InvalidHeader},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 70000 80\r\n"), "", "", InvalidHeader},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 192.0.2.2 5000 80\r\n"), "", "", InvalidHeader},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n"), "", "", InvalidHeader},
+		{"v2 tcp4", v2Header(v2CmdProxy, v2FamTCP4, tcp4), "10.0.0.1:1234", "10.0.0.2:443", nil},
+		{"v2 udp4", v2Header(v2CmdProxy, v2FamUDP4, tcp4), "10.0.0.1:1234", "10.0.0.2:443", nil},
+		{"v2 local", v2Header(v2CmdLocal, v2FamUnspec, nil), "", "", nil},
+		{"v2 short body", v2Header(v2CmdProxy, v2FamTCP4, tcp4[:8]), "", "", InvalidHeader},
+		{"v2 version 1", v2Header(0x11, v2FamTCP4, tcp4), "", "", UnsupportedVersion},
+		{"v2 bad command", v2Header(0x2f, v2FamTCP4, tcp4), "", "", InvalidHeader},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", "", InvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(append(tt.header, "data"...)))
+			source, local, err := ReadHeader(reader)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := addrString(source); got != tt.source {
+				t.Errorf("source %s, want %s", got, tt.source)
+			}
+			if got := addrString(local); got != tt.local {
+				t.Errorf("local %s, want %s", got, tt.local)
+			}
+			rest := make([]byte, 4)
+			if _, err := reader.Read(rest); err != nil || string(rest) != "data" {
+				t.Errorf("data after the header %q, %v", rest, err)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      net.Addr
+		destination net.Addr
+	}{
+		{"tcp4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80}},
+		{"tcp6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+		{"mixed families", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+		{"unix", &net.UnixAddr{Name: "/run/s.sock", Net: "unix"}, nil},
+	}
+	for _, tt := range tests {
+		for _, version := range []int{1, 2} {
+			b := &bytes.Buffer{}
+			if err := WriteHeader(b, version, tt.source, tt.destination); err != nil {
+				t.Fatalf("%s v%d: %v", tt.name, version, err)
+			}
+			source, destination, err := ReadHeader(bufio.NewReader(b))
+			if err != nil {
+				t.Fatalf("%s v%d: read back: %v", tt.name, version, err)
+			}
+			want, wantDestination := addrString(tt.source), addrString(tt.destination)
+			if _, ok := tt.source.(*net.TCPAddr); !ok || tt.name == "mixed families" {
+				// written as UNKNOWN or LOCAL
+				want, wantDestination = "", ""
+			}
+			if addrString(source) != want || addrString(destination) != wantDestination {
+				t.Errorf("%s v%d: read back %v %v", tt.name, version, source, destination)
+			}
+		}
+	}
+	if err := WriteHeader(&bytes.Buffer{}, 3, nil, nil); err != UnsupportedVersion {
+		t.Errorf("version 3: %v", err)
+	}
+}
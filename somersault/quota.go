@@ -0,0 +1,361 @@
+package somersault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var QuotaExceeded = errors.New("traffic quota exceeded")
+
+// QuotaLimit caps the traffic, upload and download together, of a user
+// per calendar day and month. Zero is unlimited.
+type QuotaLimit struct {
+	Daily   pipeline.Size `json:"daily"`
+	Monthly pipeline.Size `json:"monthly"`
+}
+
+// QuotaConfig enables traffic accounting of authenticated users. Counters
+// are saved to File every FlushInterval and when the server closes. Users
+// over their quota are refused new connections, Cut also closes the ones
+// they have open.
+type QuotaConfig struct {
+	File          string                `json:"file"`
+	FlushInterval pipeline.Duration     `json:"flush_interval"`
+	Cut           bool                  `json:"cut"`
+	Default       QuotaLimit            `json:"default"`
+	Users         map[string]QuotaLimit `json:"users"`
+}
+
+// Usage is the traffic of a user in bytes.
+type Usage struct {
+	Day           string `json:"day"`
+	Month         string `json:"month"`
+	DailyUpload   uint64 `json:"daily_upload"`
+	DailyDownload uint64 `json:"daily_download"`
+	MonthUpload   uint64 `json:"month_upload"`
+	MonthDownload uint64 `json:"month_download"`
+	TotalUpload   uint64 `json:"total_upload"`
+	TotalDownload uint64 `json:"total_download"`
+}
+
+// UserQuota is a user's usage along with its limits.
+type UserQuota struct {
+	User     string     `json:"user"`
+	Usage    Usage      `json:"usage"`
+	Limit    QuotaLimit `json:"limit"`
+	Exceeded bool       `json:"exceeded"`
+}
+
+type quota struct {
+	*QuotaConfig
+	logger *log.Logger
+	lock   sync.Mutex
+	usage  map[string]*Usage
+	conns  map[string]map[net.Conn]struct{}
+	dirty  bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (c *QuotaConfig) New(logger *log.Logger) (*quota, error) {
+	interval := 30 * time.Second
+	if c.FlushInterval != 0 {
+		interval = time.Duration(c.FlushInterval)
+	}
+	q := &quota{
+		QuotaConfig: c,
+		logger:      logger,
+		usage:       make(map[string]*Usage),
+		conns:       make(map[string]map[net.Conn]struct{}),
+		done:        make(chan struct{}),
+	}
+	err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	if c.File != "" {
+		q.wg.Add(1)
+		go q.flushLoop(interval)
+	}
+	return q, nil
+}
+
+func (q *quota) load() error {
+	if q.File == "" {
+		return nil
+	}
+	buf, err := os.ReadFile(q.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = json.Unmarshal(buf, &q.usage)
+	if err != nil {
+		return fmt.Errorf("quota file %s: %s", q.File, err)
+	}
+	return nil
+}
+
+// flush writes the counters to a temporary file renamed over the old one,
+// a crash never leaves a truncated file behind.
+func (q *quota) flush() error {
+	if q.File == "" {
+		return nil
+	}
+	q.lock.Lock()
+	if !q.dirty {
+		q.lock.Unlock()
+		return nil
+	}
+	buf, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.File), ".quota")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (q *quota) flushLoop(interval time.Duration) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.flush(); err != nil {
+				q.logger.Println("flush quota", err)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func (q *quota) Close() error {
+	close(q.done)
+	q.wg.Wait()
+	return q.flush()
+}
+
+// update switches to the limits of c, the file and flush interval stay.
+func (q *quota) update(c *QuotaConfig) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	nc := *c
+	nc.File = q.File
+	nc.FlushInterval = q.FlushInterval
+	q.QuotaConfig = &nc
+}
+
+func (q *quota) limit(user string) QuotaLimit {
+	if l, ok := q.Users[user]; ok {
+		return l
+	}
+	return q.Default
+}
+
+// current returns the usage of user for the running day and month, with
+// the lock held.
+func (q *quota) current(user string) *Usage {
+	u, ok := q.usage[user]
+	if !ok {
+		u = &Usage{}
+		q.usage[user] = u
+	}
+	*u = q.usageAt(user, time.Now())
+	return u
+}
+
+// usageAt is the usage of user at now, the counters of a past day or month
+// reset. Unlike current it changes nothing.
+func (q *quota) usageAt(user string, now time.Time) Usage {
+	var u Usage
+	if p, ok := q.usage[user]; ok {
+		u = *p
+	}
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+	if u.Day != day {
+		u.Day = day
+		u.DailyUpload, u.DailyDownload = 0, 0
+	}
+	if u.Month != month {
+		u.Month = month
+		u.MonthUpload, u.MonthDownload = 0, 0
+	}
+	return u
+}
+
+func exceeded(u *Usage, l QuotaLimit) bool {
+	if l.Daily > 0 && u.DailyUpload+u.DailyDownload >= uint64(l.Daily) {
+		return true
+	}
+	if l.Monthly > 0 && u.MonthUpload+u.MonthDownload >= uint64(l.Monthly) {
+		return true
+	}
+	return false
+}
+
+// admit refuses users over quota and keeps track of the connections of
+// the others.
+func (q *quota) admit(user string, conn net.Conn) error {
+	if user == "" {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	usage := q.usageAt(user, time.Now())
+	if exceeded(&usage, q.limit(user)) {
+		return QuotaExceeded
+	}
+	conns, ok := q.conns[user]
+	if !ok {
+		conns = make(map[net.Conn]struct{})
+		q.conns[user] = conns
+	}
+	conns[conn] = struct{}{}
+	return nil
+}
+
+func (q *quota) release(user string, conn net.Conn) {
+	if user == "" {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.conns[user], conn)
+	if len(q.conns[user]) == 0 {
+		delete(q.conns, user)
+	}
+}
+
+func (q *quota) add(user string, upload, download int) {
+	if user == "" {
+		return
+	}
+	var cut []net.Conn
+	q.lock.Lock()
+	u := q.current(user)
+	u.DailyUpload += uint64(upload)
+	u.MonthUpload += uint64(upload)
+	u.TotalUpload += uint64(upload)
+	u.DailyDownload += uint64(download)
+	u.MonthDownload += uint64(download)
+	u.TotalDownload += uint64(download)
+	q.dirty = true
+	if q.Cut && exceeded(u, q.limit(user)) {
+		for conn := range q.conns[user] {
+			cut = append(cut, conn)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, conn := range cut {
+		conn.Close()
+	}
+	if len(cut) != 0 {
+		q.logger.Printf("user %s over quota, closed %d connections\n", user, len(cut))
+	}
+}
+
+// Quota lists every known user, or only user when it is not empty.
+func (q *quota) Quota(user string) []UserQuota {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	users := []string{}
+	if user != "" {
+		_, used := q.usage[user]
+		_, limited := q.Users[user]
+		if used || limited {
+			users = append(users, user)
+		}
+	} else {
+		for u := range q.usage {
+			users = append(users, u)
+		}
+		for u := range q.Users {
+			if _, ok := q.usage[u]; !ok {
+				users = append(users, u)
+			}
+		}
+	}
+	list := make([]UserQuota, 0, len(users))
+	now := time.Now()
+	for _, u := range users {
+		usage := q.usageAt(u, now)
+		limit := q.limit(u)
+		list = append(list, UserQuota{
+			User:     u,
+			Usage:    usage,
+			Limit:    limit,
+			Exceeded: exceeded(&usage, limit),
+		})
+	}
+	return list
+}
+
+// meteredConn reports the traffic of an accepted connection, upload is what
+// the client sends. It has to see every byte, so it is no NetConner and its
+// connections are never spliced.
+type meteredConn struct {
+	net.Conn
+	account func(upload, download int)
+}
+
+func (c *meteredConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.account(n, 0)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	if n > 0 {
+		c.account(0, n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error {
+	return pipeline.CloseWrite(c.Conn)
+}
+
+func (c *meteredConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.New("not a socket")
+}
@@ -0,0 +1,44 @@
+package somersault
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// TestQuotaReadOnly queries users the quota has no counters for, or whose
+// counters are of a past day, the query must leave the counters alone.
+func TestQuotaReadOnly(t *testing.T) {
+	c := &QuotaConfig{Users: map[string]QuotaLimit{"bob": {Daily: 100}}}
+	q, err := c.New(log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	old := Usage{Day: "2000-01-01", Month: "2000-01", DailyUpload: 200, MonthUpload: 200, TotalUpload: 200}
+	q.usage["alice"] = &old
+
+	for _, user := range []string{"", "alice", "bob", "carol"} {
+		list := q.Quota(user)
+		for _, uq := range list {
+			if uq.Exceeded {
+				t.Errorf("%s: %s over quota", user, uq.User)
+			}
+			if uq.User == "alice" && (uq.Usage.DailyUpload != 0 || uq.Usage.TotalUpload != 200) {
+				t.Errorf("%s: alice usage %+v", user, uq.Usage)
+			}
+		}
+	}
+	if len(q.usage) != 1 || q.dirty {
+		t.Errorf("queries changed the counters: %d users, dirty %v", len(q.usage), q.dirty)
+	}
+	if *q.usage["alice"] != (Usage{Day: "2000-01-01", Month: "2000-01", DailyUpload: 200, MonthUpload: 200, TotalUpload: 200}) {
+		t.Errorf("alice counters changed to %+v", *q.usage["alice"])
+	}
+
+	q.add("alice", 10, 0)
+	if u := q.usage["alice"]; u.Day != time.Now().Format("2006-01-02") || u.DailyUpload != 10 || u.TotalUpload != 210 {
+		t.Errorf("alice counters %+v after traffic", *u)
+	}
+}
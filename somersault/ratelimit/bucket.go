@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket counting bytes. Takers reserve tokens up front
+// and sleep off the debt, so concurrent users of a shared bucket queue up
+// instead of spinning.
+type bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	refs   int
+}
+
+func newBucket(rate, burst int64) *bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take reserves n tokens and returns how long to wait before using them.
+func (b *bucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// max is the largest chunk worth asking for at once.
+func (b *bucket) max() int {
+	return int(b.burst)
+}
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const (
+	scopeConnection = "connection"
+	scopeUser       = "user"
+	scopeSource     = "source"
+	scopeListener   = "listener"
+)
+
+var UnknownScope = errors.New("unknown rate limit scope")
+
+// Config is the "ratelimit" stage. It limits what the client uploads and
+// downloads, in bytes per second, with token buckets shared by every
+// connection of the same scope:
+//
+//	connection  each connection on its own
+//	user        connections of the same authenticated user
+//	source      connections from the same client ip
+//	listener    every connection of the listener
+//
+// Bursts default to one second worth of traffic. Stages can be stacked to
+// combine scopes, e.g. per user under a per listener cap. A user scope only
+// starts limiting once a later stage authenticated the client.
+type Config struct {
+	Upload        pipeline.Size `somersault:"upload"`
+	Download      pipeline.Size `somersault:"download"`
+	UploadBurst   pipeline.Size `somersault:"upload_burst"`
+	DownloadBurst pipeline.Size `somersault:"download_burst"`
+	Scope         string        `somersault:"scope,default=connection,enum=connection|user|source|listener"`
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+type limiter struct {
+	pipeline.Pipeline
+	config   *Config
+	md       *pipeline.Metadata
+	lock     sync.Mutex
+	upload   *bucket
+	download *bucket
+	closed   bool
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{
+		Upload:        c.Upload,
+		Download:      c.Download,
+		UploadBurst:   c.UploadBurst,
+		DownloadBurst: c.DownloadBurst,
+		Scope:         c.Scope,
+	}
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	switch c.Scope {
+	case scopeConnection, scopeUser, scopeSource, scopeListener:
+	default:
+		return nil, UnknownScope
+	}
+	l := &limiter{
+		Pipeline: input,
+		config:   c,
+		md:       pipeline.GetMetadata(ctx),
+	}
+	if c.Scope == scopeConnection {
+		if c.Upload > 0 {
+			l.upload = newBucket(int64(c.Upload), int64(c.UploadBurst))
+		}
+		if c.Download > 0 {
+			l.download = newBucket(int64(c.Download), int64(c.DownloadBurst))
+		}
+	}
+	return l, nil
+}
+
+// key names the shared buckets of a connection, false while the scope
+// cannot be told yet.
+func (c *Config) key(md *pipeline.Metadata) (string, bool) {
+	switch c.Scope {
+	case scopeListener:
+		return "", true
+	case scopeSource:
+		if md == nil || md.Source == nil {
+			return "", false
+		}
+		if host, _, err := net.SplitHostPort(md.Source.String()); err == nil {
+			return host, true
+		}
+		return md.Source.String(), true
+	case scopeUser:
+		if md == nil || md.User == "" {
+			return "", false
+		}
+		return md.User, true
+	}
+	return "", false
+}
+
+func (c *Config) acquire(name string, rate, burst int64) *bucket {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.buckets == nil {
+		c.buckets = make(map[string]*bucket)
+	}
+	b, ok := c.buckets[name]
+	if !ok {
+		b = newBucket(rate, burst)
+		c.buckets[name] = b
+	}
+	b.refs++
+	return b
+}
+
+func (c *Config) release(name string, b *bucket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b.refs--
+	if b.refs == 0 {
+		delete(c.buckets, name)
+	}
+}
+
+// buckets resolves the shared buckets the first time the scope is known.
+func (l *limiter) buckets() (*bucket, *bucket) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.config.Scope == scopeConnection || l.closed || l.upload != nil || l.download != nil {
+		return l.upload, l.download
+	}
+	key, ok := l.config.key(l.md)
+	if !ok {
+		return nil, nil
+	}
+	if l.config.Upload > 0 {
+		l.upload = l.config.acquire("up/"+key, int64(l.config.Upload), int64(l.config.UploadBurst))
+	}
+	if l.config.Download > 0 {
+		l.download = l.config.acquire("down/"+key, int64(l.config.Download), int64(l.config.DownloadBurst))
+	}
+	return l.upload, l.download
+}
+
+func (l *limiter) Read(buf []byte) (int, error) {
+	upload, _ := l.buckets()
+	if upload == nil {
+		return l.Pipeline.Read(buf)
+	}
+	if len(buf) > upload.max() {
+		buf = buf[:upload.max()]
+	}
+	n, err := l.Pipeline.Read(buf)
+	if n > 0 {
+		time.Sleep(upload.take(n))
+	}
+	return n, err
+}
+
+func (l *limiter) Write(buf []byte) (int, error) {
+	_, download := l.buckets()
+	if download == nil {
+		return l.Pipeline.Write(buf)
+	}
+	written := 0
+	for len(buf) != 0 {
+		chunk := buf
+		if len(chunk) > download.max() {
+			chunk = chunk[:download.max()]
+		}
+		time.Sleep(download.take(len(chunk)))
+		n, err := l.Pipeline.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+func (l *limiter) CloseWrite() error {
+	return pipeline.CloseWrite(l.Pipeline)
+}
+
+func (l *limiter) Close() error {
+	l.lock.Lock()
+	if !l.closed && l.config.Scope != scopeConnection {
+		key, _ := l.config.key(l.md)
+		if l.upload != nil {
+			l.config.release("up/"+key, l.upload)
+		}
+		if l.download != nil {
+			l.config.release("down/"+key, l.download)
+		}
+	}
+	l.closed = true
+	l.lock.Unlock()
+	return l.Pipeline.Close()
+}
+
+func init() {
+	config := &Config{}
+	pipeline.RegistePipelineCreator("ratelimit", config)
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// conn reads as many zeros as asked for and takes whatever is written.
+type conn struct{}
+
+func (c conn) Read(buf []byte) (int, error)  { return len(buf), nil }
+func (c conn) Write(buf []byte) (int, error) { return len(buf), nil }
+func (c conn) Close() error                  { return nil }
+
+// read reads n bytes from p.
+func read(t *testing.T, p pipeline.Pipeline, n int) {
+	buf := make([]byte, 4096)
+	for n > 0 {
+		if n < len(buf) {
+			buf = buf[:n]
+		}
+		m, err := p.Read(buf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		n -= m
+	}
+}
+
+func newLimiter(t *testing.T, c *Config, md *pipeline.Metadata) *limiter {
+	ctx := context.Background()
+	if md != nil {
+		ctx = pipeline.WithMetadata(ctx, md)
+	}
+	p, err := c.New(ctx, conn{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*limiter)
+}
+
+// TestThrottle moves 60KB each way through a stage allowing 100KB a second
+// with a burst of 10KB, which takes half a second.
+func TestThrottle(t *testing.T) {
+	c := &Config{}
+	err := pipeline.Decode(c, map[string]interface{}{
+		"upload":         "100KB",
+		"download":       "100KB",
+		"upload_burst":   "10KB",
+		"download_burst": "10KB",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(t, c, nil)
+	defer l.Close()
+
+	start := time.Now()
+	read(t, l, 60*1000)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("uploaded 60KB in %s", elapsed)
+	}
+	start = time.Now()
+	if _, err := l.Write(make([]byte, 60*1000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("downloaded 60KB in %s", elapsed)
+	}
+}
+
+// TestUserScope checks the connections of a user share its buckets, those
+// of another user do not, and nothing is limited before a user is known.
+func TestUserScope(t *testing.T) {
+	c := &Config{}
+	err := pipeline.Decode(c, map[string]interface{}{
+		"upload":       "100KB",
+		"upload_burst": "10KB",
+		"scope":        "user",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &pipeline.Metadata{}
+	l := newLimiter(t, c, anonymous)
+	start := time.Now()
+	read(t, l, 60*1000)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("limited before any user, 60KB took %s", elapsed)
+	}
+	l.Close()
+
+	alice := []*limiter{
+		newLimiter(t, c, &pipeline.Metadata{User: "alice"}),
+		newLimiter(t, c, &pipeline.Metadata{User: "alice"}),
+	}
+	bob := newLimiter(t, c, &pipeline.Metadata{User: "bob"})
+	a0, _ := alice[0].buckets()
+	a1, _ := alice[1].buckets()
+	b, _ := bob.buckets()
+	if a0 == nil || a0 != a1 {
+		t.Errorf("alice connections have buckets %p and %p", a0, a1)
+	}
+	if b == nil || b == a0 {
+		t.Errorf("bob shares the bucket %p of alice", b)
+	}
+
+	// alice's connections share 100KB a second, bob's bucket is separate
+	var wg sync.WaitGroup
+	elapsed := make([]time.Duration, 3)
+	for i, l := range []*limiter{alice[0], alice[1], bob} {
+		wg.Add(1)
+		go func(i int, l *limiter) {
+			defer wg.Done()
+			start := time.Now()
+			read(t, l, 30*1000)
+			elapsed[i] = time.Since(start)
+		}(i, l)
+	}
+	wg.Wait()
+	if elapsed[0] < 400*time.Millisecond && elapsed[1] < 400*time.Millisecond {
+		t.Errorf("alice uploaded 60KB in %s and %s", elapsed[0], elapsed[1])
+	}
+	if elapsed[2] < 150*time.Millisecond || elapsed[2] > elapsed[0] && elapsed[2] > elapsed[1] {
+		t.Errorf("bob uploaded 30KB in %s, alice in %s and %s", elapsed[2], elapsed[0], elapsed[1])
+	}
+
+	for _, l := range append(alice, bob) {
+		l.Close()
+	}
+	if len(c.buckets) != 0 {
+		t.Errorf("%d buckets left once closed", len(c.buckets))
+	}
+}
@@ -0,0 +1,66 @@
+package redirect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var (
+	NotSocket     = errors.New("input is not a socket")
+	NotRedirected = errors.New("connection was not redirected")
+	NoMetadata    = errors.New("metadata not found")
+)
+
+// Config is the "redirect" inbound. It must be the first stage of a chain
+// listening on a port iptables REDIRECTs to, and records the original
+// destination of the connection so the following stages dial it.
+type Config struct {
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{}
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	md := pipeline.GetMetadata(ctx)
+	if md == nil {
+		return nil, NoMetadata
+	}
+	conn, ok := input.(net.Conn)
+	if !ok {
+		return nil, NotSocket
+	}
+	sc, ok := input.(syscall.Conn)
+	if !ok {
+		return nil, NotSocket
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		return nil, NotSocket
+	}
+	ip, port, err := originalDestination(sc, local.IP.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a matching nat rule the kernel reports the local address,
+	// dialing it would loop back into this listener.
+	if local.IP.Equal(ip) && local.Port == port {
+		return nil, NotRedirected
+	}
+	md.Destination = &pipeline.Address{
+		Network: "tcp",
+		Host:    ip.String(),
+		Port:    port,
+	}
+	return input, nil
+}
+
+func init() {
+	config := &Config{}
+	pipeline.RegistePipelineCreator("redirect", config)
+}
@@ -0,0 +1,54 @@
+package redirect
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST share the same value.
+const soOriginalDst = 80
+
+func originalDestination(sc syscall.Conn, ipv6 bool) (net.IP, int, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ip net.IP
+	var port int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		// The kernel fills a sockaddr_in/sockaddr_in6, the mreq and mtuinfo
+		// getters are only used because they are large enough to hold one.
+		if !ipv6 {
+			mreq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if e != nil {
+				serr = e
+				return
+			}
+			ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+			port = int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+			return
+		}
+		info, e := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if e != nil {
+			serr = e
+			return
+		}
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		var buf [2]byte
+		binary.NativeEndian.PutUint16(buf[:], info.Addr.Port)
+		port = int(binary.BigEndian.Uint16(buf[:]))
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if serr == syscall.ENOENT {
+		return nil, 0, NotRedirected
+	} else if serr != nil {
+		return nil, 0, serr
+	}
+	return ip, port, nil
+}
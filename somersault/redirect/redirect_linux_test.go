@@ -0,0 +1,29 @@
+package redirect
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// TestNotRedirected checks a connection no nat rule redirected is refused,
+// its original destination is the listener itself.
+func TestNotRedirected(t *testing.T) {
+	conn, done := tcpPair(t)
+	defer done()
+	md := &pipeline.Metadata{}
+	ctx := pipeline.WithMetadata(context.Background(), md)
+	_, err := (&Config{}).New(ctx, conn, nil)
+	if errors.Is(err, syscall.ENOPROTOOPT) {
+		t.Skip("connection tracking is not loaded:", err)
+	}
+	if err != NotRedirected {
+		t.Errorf("error %v, want %v", err, NotRedirected)
+	}
+	if md.Destination != nil {
+		t.Errorf("destination %v", md.Destination)
+	}
+}
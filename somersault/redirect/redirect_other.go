@@ -0,0 +1,13 @@
+//go:build !linux
+
+package redirect
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func originalDestination(sc syscall.Conn, ipv6 bool) (net.IP, int, error) {
+	return nil, 0, errors.New("redirect is only supported on linux")
+}
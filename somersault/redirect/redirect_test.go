@@ -0,0 +1,68 @@
+package redirect
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// tcpPair connects to a loopback listener and returns the accepted side,
+// which no nat rule redirected.
+func tcpPair(t *testing.T) (net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestNotSocket(t *testing.T) {
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tests := []struct {
+		name  string
+		input pipeline.Pipeline
+	}{
+		{"pipe", pipe},
+		{"udp", udp},
+	}
+	for _, tt := range tests {
+		md := &pipeline.Metadata{}
+		ctx := pipeline.WithMetadata(context.Background(), md)
+		_, err := (&Config{}).New(ctx, tt.input, nil)
+		if err != NotSocket {
+			t.Errorf("%s: error %v, want %v", tt.name, err, NotSocket)
+		}
+		if md.Destination != nil {
+			t.Errorf("%s: destination %v", tt.name, md.Destination)
+		}
+	}
+
+	conn, done := tcpPair(t)
+	defer done()
+	_, err = (&Config{}).New(context.Background(), conn, nil)
+	if err != NoMetadata {
+		t.Errorf("no metadata: error %v, want %v", err, NoMetadata)
+	}
+}
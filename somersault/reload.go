@@ -0,0 +1,290 @@
+package somersault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var (
+	NoLoader     = errors.New("no config loader")
+	AdminChanged = errors.New("changing the admin api needs a restart")
+)
+
+// listenSignature identifies how a listener was opened, by its options
+// other than RouteOptions.
+func listenSignature(l *Listener) (string, error) {
+	socket := *l
+	socket.RouteOptions = RouteOptions{}
+	buf, err := json.Marshal(socket)
+	return string(buf), err
+}
+
+// entries lists the listeners of the config, forwards included, along
+// with their path in the config.
+func (c *Config) entries() ([]*Listener, error) {
+	entries := make([]*Listener, 0, len(c.Config)+len(c.Forward))
+	for i, l := range c.Config {
+		if l == nil {
+			return nil, pipeline.FieldError(fmt.Sprintf("config[%d]", i), pipeline.Required)
+		}
+		l.path = fmt.Sprintf("config[%d]", i)
+		entries = append(entries, l)
+	}
+	for i := range c.Forward {
+		l, err := c.Forward[i].entry()
+		path := fmt.Sprintf("forward[%d]", i)
+		if err != nil {
+			return nil, pipeline.FieldError(path, err)
+		}
+		l.path = path
+		entries = append(entries, l)
+	}
+	return entries, nil
+}
+
+// SetLoader sets how Reload reads the config again.
+func (s *Somerasult) SetLoader(load func() (*Config, error)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load = load
+}
+
+// Reload reads the config with the loader and applies it.
+func (s *Somerasult) Reload() error {
+	s.lock.Lock()
+	load := s.load
+	s.lock.Unlock()
+	if load == nil {
+		return NoLoader
+	}
+	c, err := load()
+	if err != nil {
+		return err
+	}
+	return s.Apply(c)
+}
+
+// Apply switches to c without dropping connections. Listeners are matched
+// by network and address: new ones are started, removed ones stop
+// accepting and drain within the grace period, and the others serve the
+// connections they accept from now on with their new settings. A listener
+// whose socket options changed is restarted. The new listeners are bound
+// while the old ones still serve, the old ones close first only where they
+// are in the way, and listen again when a new one fails. Nothing changes
+// when c is invalid or can not be started. Changing the admin API needs a
+// restart.
+func (s *Somerasult) Apply(c *Config) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	grace := defaultGracePeriod
+	if c.GracePeriod != nil {
+		grace = time.Duration(*c.GracePeriod)
+	}
+	listeners, err := c.entries()
+	if err != nil {
+		return err
+	}
+	planned := make(map[string]*entry)
+	var order []*entry
+	for _, l := range listeners {
+		e, err := s.plan(l)
+		if err != nil {
+			return err
+		}
+		if _, ok := planned[e.key]; ok {
+			return pipeline.FieldError(l.path, fmt.Errorf("listener %s defined twice", e.addr))
+		}
+		planned[e.key] = e
+		order = append(order, e)
+	}
+
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return net.ErrClosed
+	}
+	if !reflect.DeepEqual(s.Config.Admin, c.Admin) {
+		s.lock.Unlock()
+		return pipeline.FieldError("admin", AdminChanged)
+	}
+	var kept, stale []*service
+	running := make(map[string]*service)
+	for _, srv := range s.services {
+		e, ok := planned[srv.key]
+		if ok && e.signature == srv.signature {
+			kept = append(kept, srv)
+		} else {
+			stale = append(stale, srv)
+		}
+		running[srv.key] = srv
+	}
+	s.lock.Unlock()
+
+	// bind the new listeners, those on the address of a stale one, or
+	// failing maybe because of one, are tried again once the stale ones
+	// stopped
+	var blocked []*entry
+	var services []*service
+	for _, e := range order {
+		if srv, ok := running[e.key]; ok && srv.signature == e.signature {
+			continue
+		} else if ok {
+			blocked = append(blocked, e)
+			continue
+		}
+		srv, err := s.bind(e)
+		if err != nil {
+			blocked = append(blocked, e)
+			continue
+		}
+		services = append(services, srv)
+	}
+	if len(blocked) != 0 {
+		for _, srv := range stale {
+			if err := srv.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf("close %s: %s\n", srv.addr, err)
+			}
+		}
+		for _, e := range blocked {
+			srv, err := s.bind(e)
+			if err != nil {
+				errs := &pipeline.Error{}
+				errs.Append(fmt.Errorf("listener %s: %s", e.addr, err))
+				s.rollback(services, stale, errs)
+				return errs
+			}
+			services = append(services, srv)
+		}
+	}
+
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		for _, srv := range services {
+			srv.Close()
+		}
+		return net.ErrClosed
+	}
+	for _, srv := range kept {
+		srv.swap(mergeRoute(srv.current(), planned[srv.key].route))
+	}
+	s.services = append(kept, services...)
+	s.loops.Add(len(services))
+	s.Config = c
+	s.grace = grace
+	s.lock.Unlock()
+
+	if s.quota != nil && c.Quota != nil {
+		s.quota.update(c.Quota)
+	} else if (s.quota == nil) != (c.Quota == nil) {
+		s.logger.Println("enabling or disabling quota needs a restart")
+	}
+
+	for _, srv := range stale {
+		s.logger.Printf("stop server on %s\n", srv.addr)
+		s.retire(srv)
+	}
+	for _, srv := range services {
+		go s.accept(srv)
+	}
+	return nil
+}
+
+// rollback closes the listeners a failed Apply bound and has the stale ones
+// it stopped listen again, errors restoring them are added to errs.
+func (s *Somerasult) rollback(bound, stale []*service, errs *pipeline.Error) {
+	for _, srv := range bound {
+		srv.Close()
+	}
+	for _, srv := range stale {
+		if err := s.restore(srv); err != nil {
+			errs.Append(fmt.Errorf("restore listener %s: %s", srv.addr, err))
+		}
+	}
+}
+
+// restore listens again for old, whose listener a failed Apply closed. The
+// new service takes over its route and connections. When old can not listen
+// again it is retired.
+func (s *Somerasult) restore(old *service) error {
+	srv, err := s.bind(old.entry)
+	if err != nil {
+		s.lock.Lock()
+		for i, x := range s.services {
+			if x == old {
+				s.services = append(s.services[:i:i], s.services[i+1:]...)
+				break
+			}
+		}
+		s.lock.Unlock()
+		s.retire(old)
+		return err
+	}
+	srv.route = old.current()
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		srv.Close()
+		return net.ErrClosed
+	}
+	for i, x := range s.services {
+		if x == old {
+			s.services[i] = srv
+		}
+	}
+	for conn, owner := range s.conns {
+		if owner == old {
+			s.conns[conn] = srv
+		}
+	}
+	s.loops.Add(1)
+	s.lock.Unlock()
+
+	go s.accept(srv)
+	return nil
+}
+
+// mergeRoute keeps the state of the old route where the settings did not
+// change, so limits keep counting the open connections.
+func mergeRoute(old, r *route) *route {
+	if old.admission.sameLimits(r.admission) {
+		r.admission = old.admission
+	}
+	atomic.StoreUint64(&r.acl.denied, atomic.LoadUint64(&old.acl.denied))
+	return r
+}
+
+// retire closes the listener of srv and, after the grace period, the
+// connections it accepted that are still open.
+func (s *Somerasult) retire(srv *service) {
+	err := srv.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Printf("close %s: %s\n", srv.addr, err)
+	}
+	s.lock.Lock()
+	grace := s.grace
+	s.lock.Unlock()
+	time.AfterFunc(grace, func() {
+		s.lock.Lock()
+		var conns []*trackedConn
+		for conn, owner := range s.conns {
+			if owner == srv {
+				conns = append(conns, conn)
+			}
+		}
+		s.lock.Unlock()
+		if len(conns) != 0 {
+			s.logger.Printf("grace period over, closing %d connections of %s\n", len(conns), srv.addr)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package somersault
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+// ping sends a line through the listener on addr to the echo server.
+func ping(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := []byte("ping")
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, buf)
+	return err
+}
+
+func TestApply(t *testing.T) {
+	target, stop := echoServer(t)
+	defer stop()
+	config := func(admin string, listeners ...string) *Config {
+		data := `{"grace_period": "100ms", ` + admin + `"config": [`
+		for i, l := range listeners {
+			if i != 0 {
+				data += ", "
+			}
+			data += `{"address": "127.0.0.1", ` + l + `, "pipeline": ["tcp://` + target + `"]}`
+		}
+		c, err := ParseConfig([]byte(data + `]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	addr := func(port string) string {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+
+	// taken is held by someone else, a listener on it can not start
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := `"port": ` + portOf(taken.Addr())
+
+	a, b, c := freePort(t), freePort(t), freePort(t)
+	s, err := config("", `"port": `+a, `"port": `+b).New(log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		config *Config
+		ok     bool
+		up     []string
+		down   []string
+	}{
+		// b is removed and a restarted, as its name changed, before the
+		// taken port fails: both listen again
+		{"rollback", config("", `"port": `+a+`, "name": "x"`, `"port": `+c, takenPort), false, []string{a, b}, []string{c}},
+		{"admin", config(`"admin": {"address": "127.0.0.1:0"}, `, `"port": `+a), false, []string{a, b}, nil},
+		{"switch", config("", `"port": `+a+`, "name": "x"`, `"port": `+c), true, []string{a, c}, []string{b}},
+	}
+	for _, tt := range tests {
+		before := s.Config
+		err := s.Apply(tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && s.Config != before {
+			t.Errorf("%s: config switched", tt.name)
+		}
+		for _, port := range tt.up {
+			if err := ping(addr(port)); err != nil {
+				t.Errorf("%s: %s down: %v", tt.name, port, err)
+			}
+		}
+		for _, port := range tt.down {
+			if ping(addr(port)) == nil {
+				t.Errorf("%s: %s up", tt.name, port)
+			}
+		}
+		if len(s.services) != len(tt.up) {
+			t.Errorf("%s: %d services, want %d", tt.name, len(s.services), len(tt.up))
+		}
+	}
+	if err := s.Apply(config(`"admin": {"address": "127.0.0.1:0"}, `)); !errors.Is(err, AdminChanged) {
+		t.Errorf("admin change: %v, want %v", err, AdminChanged)
+	}
+}
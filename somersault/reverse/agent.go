@@ -0,0 +1,232 @@
+package reverse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+// AgentConfig is the "reverse" network, a listener that dials out to the
+// tunnel stage of a public server instead of listening. The streams the
+// server opens through it are accepted as connections and run through the
+// chain of the entry, typically a "tcp" stage to the local service.
+// With Bind set the server listens on that address for the tunnel.
+type AgentConfig struct {
+	Tunnel string `somersault:"tunnel,required"`
+	Token  string `somersault:"token,required"`
+	Bind   string `somersault:"bind"`
+}
+
+type agent struct {
+	*AgentConfig
+	server    string
+	conns     chan net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    chan struct{}
+	closeOnce sync.Once
+	lock      sync.Mutex
+	control   net.Conn
+	logger    *log.Logger
+	// running counts run and the open goroutines, Close waits for them
+	running sync.WaitGroup
+}
+
+// agentConn is a stream opened for one public connection, it reports the
+// public client as its remote address.
+type agentConn struct {
+	net.Conn
+	source net.Addr
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "reverse"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+func (c *AgentConfig) DeepCopy() pipeline.ListenerConfig {
+	return &AgentConfig{
+		Tunnel: c.Tunnel,
+		Token:  c.Token,
+		Bind:   c.Bind,
+	}
+}
+
+func (c *AgentConfig) Listen(ctx context.Context, address string, port int) (net.Listener, error) {
+	if c.Tunnel == "" || c.Token == "" {
+		return nil, errors.New("reverse agent needs a tunnel and a token")
+	}
+	a := &agent{
+		AgentConfig: c,
+		server:      net.JoinHostPort(address, strconv.Itoa(port)),
+		conns:       make(chan net.Conn),
+		closed:      make(chan struct{}),
+		logger:      pipeline.Logger(ctx),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.running.Add(1)
+	go func() {
+		defer a.running.Done()
+		a.run()
+	}()
+	return a, nil
+}
+
+func (a *agent) run() {
+	retry := minRetryInterval
+	for {
+		start := time.Now()
+		err := a.serve()
+		select {
+		case <-a.closed:
+			return
+		default:
+		}
+		a.logger.Printf("reverse tunnel %s to %s: %s\n", a.Tunnel, a.server, err)
+		if time.Since(start) > maxRetryInterval {
+			retry = minRetryInterval
+		}
+		timer := time.NewTimer(retry)
+		select {
+		case <-timer.C:
+		case <-a.closed:
+			timer.Stop()
+			return
+		}
+		retry *= 2
+		if retry > maxRetryInterval {
+			retry = maxRetryInterval
+		}
+	}
+}
+
+// serve registers the tunnel and handles the server requests until the
+// control connection breaks.
+func (a *agent) serve() error {
+	conn, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	a.lock.Lock()
+	a.control = conn
+	a.lock.Unlock()
+	select {
+	case <-a.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	register := fmt.Sprintf("%s %s %s", cmdRegister, a.Tunnel, a.Token)
+	if a.Bind != "" {
+		register += " " + a.Bind
+	}
+	_, err = fmt.Fprintf(conn, "%s\n", register)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	fields, err := readLine(reader)
+	if err != nil {
+		return err
+	}
+	if len(fields) != 2 || fields[0] != replyOK {
+		return fmt.Errorf("register refused: %v", fields)
+	}
+	session := fields[1]
+
+	for {
+		fields, err := readLine(reader)
+		if err != nil {
+			return err
+		}
+		if len(fields) == 4 && fields[0] == cmdOpen {
+			id, nonce, source := fields[1], fields[2], fields[3]
+			a.running.Add(1)
+			go func() {
+				defer a.running.Done()
+				a.open(session, id, nonce, source)
+			}()
+		}
+	}
+}
+
+func (a *agent) dial() (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(a.ctx, "tcp", a.server)
+}
+
+func (a *agent) open(session, id, nonce, source string) {
+	conn, err := a.dial()
+	if err != nil {
+		a.logger.Printf("reverse tunnel %s open %s: %s\n", a.Tunnel, id, err)
+		return
+	}
+	_, err = fmt.Fprintf(conn, "%s %s %s %s %s %s\n", cmdData, a.Tunnel, session, id, nonce, a.Token)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var c net.Conn = conn
+	if addr, err := net.ResolveTCPAddr("tcp", source); err == nil {
+		c = &agentConn{conn, addr}
+	}
+	select {
+	case a.conns <- c:
+	case <-a.closed:
+		conn.Close()
+	}
+}
+
+func (c *agentConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+func (c *agentConn) CloseWrite() error {
+	return pipeline.CloseWrite(c.Conn)
+}
+
+func (a *agent) Accept() (net.Conn, error) {
+	select {
+	case conn := <-a.conns:
+		return conn, nil
+	case <-a.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (a *agent) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		a.cancel()
+		a.lock.Lock()
+		if a.control != nil {
+			a.control.Close()
+		}
+		a.lock.Unlock()
+		a.running.Wait()
+	})
+	return nil
+}
+
+func (a *agent) Addr() net.Addr {
+	return tunnelAddr(a.server + "/" + a.Tunnel)
+}
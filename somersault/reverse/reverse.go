@@ -0,0 +1,424 @@
+package reverse
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// The control protocol is line based. An agent registers a tunnel over its
+// control connection and gets a random session nonce back,
+//
+//	REGISTER <tunnel> <token> [bind address]
+//	OK <session> | ERR <reason>
+//
+// then the server asks for a stream whenever a public connection comes in,
+// with a random nonce for each, and the agent answers with a new
+// connection carrying it,
+//
+//	OPEN <id> <nonce> <client address>
+//	DATA <tunnel> <session> <id> <nonce> <token>
+//
+// The server listens for the tunnel on the address the tunnel stage
+// configures for it, or on the bind address the agent asks for, the way
+// ssh -R does.
+const (
+	cmdRegister = "REGISTER"
+	cmdOpen     = "OPEN"
+	cmdData     = "DATA"
+	cmdPing     = "PING"
+	replyOK     = "OK"
+	replyError  = "ERR"
+
+	maxLineLength = 1024
+	nonceLength   = 16
+	openTimeout   = 10 * time.Second
+	pingInterval  = 30 * time.Second
+)
+
+var (
+	NoTunnel      = errors.New("tunnel not registered")
+	BadToken      = errors.New("bad tunnel token")
+	BadCommand    = errors.New("bad tunnel command")
+	DuplicateName = errors.New("tunnel already registered")
+	BindRefused   = errors.New("binding is not allowed")
+	OpenTimeout   = errors.New("agent did not open the stream in time")
+	LineTooLong   = errors.New("line too long")
+)
+
+// session is the server side of a registered tunnel.
+type session struct {
+	name    string
+	nonce   string
+	tunnels *registry
+	control pipeline.Pipeline
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]*request
+	closed  chan struct{}
+	once    sync.Once
+	public  net.Listener
+}
+
+// request is an OPEN waiting for the agent to connect back.
+type request struct {
+	nonce string
+	ch    chan pipeline.Pipeline
+}
+
+// registry holds the sessions registered through one tunnel stage.
+type registry struct {
+	lock     sync.RWMutex
+	sessions map[string]*session
+}
+
+func (r *registry) get(name string) *session {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.sessions[name]
+}
+
+func (r *registry) add(s *session) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sessions[s.name]; ok {
+		return false
+	}
+	r.sessions[s.name] = s
+	return true
+}
+
+func (r *registry) remove(s *session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sessions[s.name] == s {
+		delete(r.sessions, s.name)
+	}
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, nonceLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *session) send(line string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.control.Write([]byte(line + "\n"))
+	return err
+}
+
+// open asks the agent for a stream and waits for it to show up.
+func (s *session) open(source net.Addr) (pipeline.Pipeline, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	req := &request{nonce: nonce, ch: make(chan pipeline.Pipeline, 1)}
+	s.lock.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = req
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, id)
+		s.lock.Unlock()
+	}()
+
+	src := "-"
+	if source != nil {
+		src = source.String()
+	}
+	err = s.send(fmt.Sprintf("%s %d %s %s", cmdOpen, id, nonce, src))
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	timer := time.NewTimer(openTimeout)
+	defer timer.Stop()
+	select {
+	case p := <-req.ch:
+		return p, nil
+	case <-s.closed:
+		return nil, NoTunnel
+	case <-timer.C:
+		return nil, OpenTimeout
+	}
+}
+
+// deliver hands p to the OPEN id waits on, if it presents the nonce issued
+// with it.
+func (s *session) deliver(id uint64, nonce string, p pipeline.Pipeline) bool {
+	s.lock.Lock()
+	req, ok := s.pending[id]
+	s.lock.Unlock()
+	if !ok || !checkToken(req.nonce, nonce) {
+		return false
+	}
+	select {
+	case req.ch <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.closed)
+		s.control.Close()
+		if s.public != nil {
+			s.public.Close()
+		}
+		s.tunnels.remove(s)
+	})
+}
+
+// keepalive notices dead agents, the reads also drain anything the agent
+// sends back on the control connection.
+func (s *session) keepalive(reader *bufio.Reader) {
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.send(cmdPing) != nil {
+					s.close()
+					return
+				}
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+	for {
+		_, err := readLine(reader)
+		if err != nil {
+			s.close()
+			return
+		}
+	}
+}
+
+func readLine(reader *bufio.Reader) ([]string, error) {
+	line := make([]byte, 0, 64)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxLineLength {
+			return nil, LineTooLong
+		}
+		line = append(line, b)
+	}
+	return strings.Fields(strings.TrimSuffix(string(line), "\r")), nil
+}
+
+func checkToken(want, got string) bool {
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// bind opens a public listener for the tunnel while the agent is
+// registered, the server serves it like the listener of the tunnel stage
+// and carries its connections through the session.
+func (s *session) bind(ctx context.Context, address string) error {
+	md := pipeline.GetMetadata(ctx)
+	if md == nil || md.Serve == nil {
+		return BindRefused
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	err = md.Serve(l, []pipeline.Config{&publicConfig{s}})
+	if err != nil {
+		l.Close()
+		return err
+	}
+	s.public = l
+	return nil
+}
+
+// TunnelConfig is the "tunnel" stage on the server listener agents connect
+// to, it serves both their control and data connections. Agents have to
+// know the token. Listen maps tunnel names to the public address the
+// server listens on while they are registered, agents may only ask for an
+// address of their own with AllowBind. Tunnel names are scoped to the
+// stage, two listeners may serve tunnels of the same name.
+type TunnelConfig struct {
+	Token     string            `somersault:"token,required"`
+	Listen    map[string]string `somersault:"listen"`
+	AllowBind bool              `somersault:"allow_bind"`
+
+	once    sync.Once
+	tunnels *registry
+}
+
+func (c *TunnelConfig) DeepCopy() pipeline.Config {
+	return &TunnelConfig{
+		Token:     c.Token,
+		Listen:    c.Listen,
+		AllowBind: c.AllowBind,
+	}
+}
+
+func (c *TunnelConfig) registry() *registry {
+	c.once.Do(func() {
+		c.tunnels = &registry{sessions: make(map[string]*session)}
+	})
+	return c.tunnels
+}
+
+func (c *TunnelConfig) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	reader := bufio.NewReader(input)
+	fields, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case (len(fields) == 3 || len(fields) == 4) && fields[0] == cmdRegister:
+		if !checkToken(c.Token, fields[2]) {
+			fmt.Fprintf(input, "%s %s\n", replyError, BadToken)
+			return nil, BadToken
+		}
+		nonce, err := newNonce()
+		if err != nil {
+			return nil, err
+		}
+		s := &session{
+			name:    fields[1],
+			nonce:   nonce,
+			tunnels: c.registry(),
+			control: input,
+			pending: make(map[uint64]*request),
+			closed:  make(chan struct{}),
+		}
+		if !s.tunnels.add(s) {
+			fmt.Fprintf(input, "%s %s\n", replyError, DuplicateName)
+			return nil, DuplicateName
+		}
+
+		address, ok := c.Listen[s.name]
+		switch {
+		case ok:
+			err = s.bind(ctx, address)
+		case len(fields) == 4 && c.AllowBind:
+			err = s.bind(ctx, fields[3])
+		case len(fields) == 4:
+			err = BindRefused
+		}
+		if err != nil {
+			fmt.Fprintf(input, "%s %s\n", replyError, err)
+			s.close()
+			return nil, err
+		}
+		err = s.send(replyOK + " " + s.nonce)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		pipeline.Go(ctx, func() { s.keepalive(reader) })
+		return &handedOff{input}, nil
+	case len(fields) == 6 && fields[0] == cmdData:
+		if !checkToken(c.Token, fields[5]) {
+			return nil, BadToken
+		}
+		s := c.registry().get(fields[1])
+		if s == nil || !checkToken(s.nonce, fields[2]) {
+			return nil, NoTunnel
+		}
+		id, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return nil, BadCommand
+		}
+		var p pipeline.Pipeline = input
+		if n := reader.Buffered(); n != 0 {
+			buf, _ := reader.Peek(n)
+			p = pipeline.NewReplay(buf, input)
+		}
+		if !s.deliver(id, fields[4], p) {
+			return nil, OpenTimeout
+		}
+		return &handedOff{input}, nil
+	}
+	return nil, BadCommand
+}
+
+// handedOff is a connection the tunnel stage passed on, a control one to
+// its session and a data one to the public connection it carries, see
+// pipeline.NewChain.
+type handedOff struct {
+	pipeline.Pipeline
+}
+
+// publicConfig is the stage on a public listener of a session, it carries
+// each connection through a stream the agent opens for it.
+type publicConfig struct {
+	session *session
+}
+
+type Reverse struct {
+	*publicConfig
+	*pipeline.DefaultPipeline
+}
+
+func (c *publicConfig) DeepCopy() pipeline.Config {
+	return &publicConfig{c.session}
+}
+
+func (c *publicConfig) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	var source net.Addr
+	if md := pipeline.GetMetadata(ctx); md != nil {
+		source = md.Source
+	}
+	output, err := c.session.open(source)
+	if err != nil {
+		return nil, err
+	}
+
+	dp, err := pipeline.NewDefaultPipeline(ctx, input, output)
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	r := &Reverse{
+		c,
+		dp,
+	}
+	pipeline.Go(ctx, r.Transport)
+	return r, nil
+}
+
+func init() {
+	pipeline.RegistePipelineCreator("tunnel", &TunnelConfig{})
+	pipeline.RegisteListenerCreator("reverse", &AgentConfig{})
+}
@@ -0,0 +1,207 @@
+package reverse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// conn reads the request in r and records the replies.
+type conn struct {
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *conn) Read(buf []byte) (int, error)  { return c.r.Read(buf) }
+func (c *conn) Write(buf []byte) (int, error) { return c.w.Write(buf) }
+func (c *conn) Close() error                  { return nil }
+
+// serve runs the connections of l through chain, the way the server does
+// for the listeners of a listener and those stages open.
+func serve(t *testing.T, l net.Listener, chain []pipeline.Config, publics chan<- net.Listener) {
+	md := &pipeline.Metadata{
+		Serve: func(l net.Listener, chain []pipeline.Config) error {
+			go serve(t, l, chain, nil)
+			publics <- l
+			return nil
+		},
+	}
+	ctx := pipeline.WithMetadata(context.Background(), md)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, err := pipeline.NewChain(ctx, chain, c)
+			if err != nil {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// agentListen starts an agent for tunnel web against server, it hands its
+// streams to target.
+func agentListen(t *testing.T, server net.Addr, token, target string) net.Listener {
+	host, port, _ := net.SplitHostPort(server.String())
+	n, _ := strconv.Atoi(port)
+	agent, err := (&AgentConfig{Tunnel: "web", Token: token}).Listen(context.Background(), host, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := agent.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, c)
+				io.Copy(c, upstream)
+			}()
+		}
+	}()
+	return agent
+}
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// TestRoundTrip registers an agent, connects to the port the server opens
+// for it and expects the bytes to come back from the local target.
+func TestRoundTrip(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c := &TunnelConfig{Token: "s3cret", Listen: map[string]string{"web": "127.0.0.1:0"}}
+	publics := make(chan net.Listener, 1)
+	go serve(t, l, []pipeline.Config{c}, publics)
+
+	agent := agentListen(t, l.Addr(), "s3cret", target.Addr().String())
+	defer agent.Close()
+
+	var public net.Listener
+	select {
+	case public = <-publics:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not registered")
+	}
+	defer public.Close()
+
+	client, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("read %q, want %q", buf, "ping")
+	}
+}
+
+// TestBadToken registers a tunnel and sends the tunnel stage control and
+// data connections that do not know the token, the session nonce or the
+// nonce of the stream.
+func TestBadToken(t *testing.T) {
+	c := &TunnelConfig{Token: "s3cret"}
+	control, agent := net.Pipe()
+	defer agent.Close()
+	go agent.Write([]byte("REGISTER web s3cret\n"))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.New(context.Background(), control, nil)
+		errc <- err
+	}()
+	reply, err := readLine(bufio.NewReader(agent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.registry().get("web")
+	if s == nil {
+		t.Fatal("tunnel not registered")
+	}
+	if len(reply) != 2 || reply[0] != replyOK || reply[1] != s.nonce {
+		t.Errorf("replied %q", reply)
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		err     error
+		reply   string
+	}{
+		{"register", "REGISTER other wrong\n", BadToken, "ERR bad tunnel token\n"},
+		{"duplicate", "REGISTER web s3cret\n", DuplicateName, "ERR tunnel already registered\n"},
+		{"data", "DATA web " + s.nonce + " 1 00 wrong\n", BadToken, ""},
+		{"session", "DATA web 00 1 00 s3cret\n", NoTunnel, ""},
+		{"stream", "DATA web " + s.nonce + " 1 00 s3cret\n", OpenTimeout, ""},
+		{"short", "DATA web 1 s3cret\n", BadCommand, ""},
+	}
+	for _, tt := range tests {
+		input := &conn{r: bytes.NewReader([]byte(tt.request))}
+		_, err := c.New(context.Background(), input, nil)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if got := input.w.String(); got != tt.reply {
+			t.Errorf("%s: replied %q, want %q", tt.name, got, tt.reply)
+		}
+	}
+
+	// another tunnel stage knows nothing of the session
+	other := &TunnelConfig{Token: "s3cret"}
+	input := &conn{r: bytes.NewReader([]byte("DATA web " + s.nonce + " 1 00 s3cret\n"))}
+	_, err = other.New(context.Background(), input, nil)
+	if err != NoTunnel {
+		t.Errorf("other stage: error %v, want %v", err, NoTunnel)
+	}
+}
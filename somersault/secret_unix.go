@@ -0,0 +1,20 @@
+//go:build !windows
+
+package somersault
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkSecret refuses a secret file its group or others may access.
+func checkSecret(name string, info os.FileInfo) error {
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s has mode %s, group and others must not access it", name, info.Mode().Perm())
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s belongs to user %d", name, st.Uid)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package somersault
+
+import "os"
+
+// checkSecret trusts the ACL of the secret file, windows has no mode bits
+// to check and nothing refuses a file Everyone may read.
+func checkSecret(name string, info os.FileInfo) error {
+	return nil
+}
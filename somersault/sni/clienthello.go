@@ -0,0 +1,168 @@
+package sni
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const (
+	recordTypeHandshake  = 0x16
+	handshakeTypeHello   = 0x01
+	extensionServerName  = 0
+	extensionALPN        = 16
+	maxClientHelloLength = 64 * 1024
+	// maxPeekLength bounds the records read for a ClientHello, real ones
+	// fit in a few KiB
+	maxPeekLength          = 16 * 1024
+	recordHeaderLength     = 5
+	handshakeHeaderLength  = 4
+	serverNameTypeHostName = 0
+)
+
+var (
+	NotTLS         = errors.New("not a tls handshake")
+	BadClientHello = errors.New("malformed client hello")
+)
+
+type clientHello struct {
+	serverName string
+	alpn       []string
+}
+
+// readClientHello reads the records carrying the ClientHello and returns
+// them raw along with what was parsed, the caller replays them upstream.
+// At most maxPeekLength bytes are read, within the handshake timeout of the
+// listener.
+func readClientHello(input pipeline.Pipeline) (*clientHello, []byte, error) {
+	var raw []byte
+	var handshake []byte
+	for {
+		header := make([]byte, recordHeaderLength)
+		_, err := io.ReadFull(input, header)
+		if err != nil {
+			return nil, raw, err
+		}
+		raw = append(raw, header...)
+		if header[0] != recordTypeHandshake {
+			return nil, raw, NotTLS
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length == 0 || len(raw)+length > maxPeekLength {
+			// empty handshake records are not allowed, and would keep
+			// us reading forever
+			return nil, raw, BadClientHello
+		}
+		record := make([]byte, length)
+		_, err = io.ReadFull(input, record)
+		if err != nil {
+			return nil, raw, err
+		}
+		raw = append(raw, record...)
+		handshake = append(handshake, record...)
+
+		if len(handshake) < handshakeHeaderLength {
+			continue
+		}
+		if handshake[0] != handshakeTypeHello {
+			return nil, raw, NotTLS
+		}
+		size := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if size > maxClientHelloLength {
+			return nil, raw, BadClientHello
+		}
+		if len(handshake) >= handshakeHeaderLength+size {
+			hello, err := parseClientHello(handshake[handshakeHeaderLength : handshakeHeaderLength+size])
+			return hello, raw, err
+		}
+	}
+}
+
+type reader struct {
+	buf []byte
+	err bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err || len(r.buf) < n {
+		r.err = true
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func parseClientHello(body []byte) (*clientHello, error) {
+	r := &reader{buf: body}
+	r.bytes(2)  // client_version
+	r.bytes(32) // random
+	r.bytes(r.uint8())
+	r.bytes(r.uint16())
+	r.bytes(r.uint8())
+	if r.err {
+		return nil, BadClientHello
+	}
+
+	hello := &clientHello{}
+	if len(r.buf) == 0 {
+		// no extensions at all
+		return hello, nil
+	}
+	extensions := &reader{buf: r.bytes(r.uint16())}
+	if r.err {
+		return nil, BadClientHello
+	}
+	for len(extensions.buf) != 0 {
+		typ := extensions.uint16()
+		ext := &reader{buf: extensions.bytes(extensions.uint16())}
+		if extensions.err {
+			return nil, BadClientHello
+		}
+		switch typ {
+		case extensionServerName:
+			names := &reader{buf: ext.bytes(ext.uint16())}
+			for len(names.buf) != 0 {
+				nameType := names.uint8()
+				name := names.bytes(names.uint16())
+				if names.err {
+					return nil, BadClientHello
+				}
+				if nameType == serverNameTypeHostName {
+					hello.serverName = string(name)
+				}
+			}
+		case extensionALPN:
+			protocols := &reader{buf: ext.bytes(ext.uint16())}
+			for len(protocols.buf) != 0 {
+				protocol := protocols.bytes(protocols.uint8())
+				if protocols.err {
+					return nil, BadClientHello
+				}
+				hello.alpn = append(hello.alpn, string(protocol))
+			}
+		}
+		if ext.err {
+			return nil, BadClientHello
+		}
+	}
+	return hello, nil
+}
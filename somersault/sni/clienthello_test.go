@@ -0,0 +1,96 @@
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+type input struct {
+	*bytes.Reader
+}
+
+func (input) Write(buf []byte) (int, error) { return len(buf), nil }
+func (input) Close() error                  { return nil }
+
+// captureHello returns the ClientHello handshake message crypto/tls sends.
+func captureHello(t *testing.T, serverName string, alpn []string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn}).Handshake()
+	}()
+	header := make([]byte, recordHeaderLength)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+	if _, err := io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// records splits a handshake message into records of at most size bytes.
+func records(msg []byte, size int) []byte {
+	var buf []byte
+	for len(msg) != 0 {
+		n := size
+		if n > len(msg) {
+			n = len(msg)
+		}
+		buf = append(buf, recordTypeHandshake, 3, 1)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		buf = append(buf, msg[:n]...)
+		msg = msg[n:]
+	}
+	return buf
+}
+
+func TestReadClientHello(t *testing.T) {
+	msg := captureHello(t, "example.com", []string{"h2", "http/1.1"})
+	endless := []byte{handshakeTypeHello, 0, 0xff, 0xff}
+	endless = append(endless, make([]byte, 2*maxPeekLength)...)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		serverName string
+		err        error
+	}{
+		{"one record", records(msg, len(msg)), "example.com", nil},
+		{"fragmented", records(msg, 7), "example.com", nil},
+		{"empty records", append(records(nil, 1), bytes.Repeat([]byte{recordTypeHandshake, 3, 1, 0, 0}, 100)...), "", BadClientHello},
+		{"past the peek limit", records(endless, 1), "", BadClientHello},
+		{"not a handshake", []byte{0x17, 3, 3, 0, 1, 0}, "", NotTLS},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), "", NotTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, raw, err := readClientHello(input{bytes.NewReader(tt.data)})
+			if err != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if len(raw) > maxPeekLength+recordHeaderLength {
+				t.Errorf("read %d bytes", len(raw))
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(raw, tt.data) {
+				t.Errorf("raw records differ from what was read")
+			}
+			if hello.serverName != tt.serverName {
+				t.Errorf("server name %q, want %q", hello.serverName, tt.serverName)
+			}
+			if len(hello.alpn) != 2 || hello.alpn[0] != "h2" {
+				t.Errorf("alpn %q", hello.alpn)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package sni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var NoRoute = errors.New("no route for server name")
+
+// Config is the "sni" inbound. It peeks at the ClientHello without
+// terminating tls and hands the untouched stream to the chain of the first
+// route matching its server_name and alpn.
+//
+//	"routes": [
+//	  {"server_name": ["*.example.com"], "alpn": ["h2"], "pipeline": [...]},
+//	  {"server_name": "example.org", "pipeline": [...]}
+//	],
+//	"default": [...]
+type Config struct {
+	Routes  []Route       `somersault:"routes"`
+	Default []interface{} `somersault:"default"`
+
+	once     sync.Once
+	routes   []*route
+	fallback []pipeline.Config
+	err      error
+}
+
+// Route sends the connections matching one of ServerName, and one of ALPN
+// when given, to Pipeline.
+type Route struct {
+	ServerName []string      `somersault:"server_name"`
+	ALPN       []string      `somersault:"alpn"`
+	Pipeline   []interface{} `somersault:"pipeline,required"`
+}
+
+type SNI struct {
+	*Config
+	pipeline.Pipeline
+}
+
+type route struct {
+	serverNames []string
+	alpn        []string
+	chain       []pipeline.Config
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{
+		Routes:  c.Routes,
+		Default: c.Default,
+	}
+}
+
+func (c *Config) parse() error {
+	c.once.Do(func() {
+		for i, r := range c.Routes {
+			chain, err := pipeline.ParseChain(r.Pipeline)
+			if err != nil {
+				c.err = pipeline.FieldError(fmt.Sprintf("routes[%d].pipeline", i), err)
+				return
+			}
+			c.routes = append(c.routes, &route{
+				serverNames: r.ServerName,
+				alpn:        r.ALPN,
+				chain:       chain,
+			})
+		}
+		if c.Default != nil {
+			c.fallback, c.err = pipeline.ParseChain(c.Default)
+			c.err = pipeline.FieldError("default", c.err)
+		}
+	})
+	return c.err
+}
+
+// Validate builds the chains, so errors show when the config is read.
+func (c *Config) Validate() error {
+	return c.parse()
+}
+
+func matchServerName(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return pattern == name
+}
+
+func (r *route) match(hello *clientHello) bool {
+	if len(r.serverNames) != 0 {
+		matched := false
+		for _, pattern := range r.serverNames {
+			if hello.serverName != "" && matchServerName(pattern, hello.serverName) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.alpn) != 0 {
+		for _, want := range r.alpn {
+			for _, protocol := range hello.alpn {
+				if want == protocol {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (c *Config) route(hello *clientHello) []pipeline.Config {
+	for _, r := range c.routes {
+		if r.match(hello) {
+			return r.chain
+		}
+	}
+	return c.fallback
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	err := c.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	hello, raw, err := readClientHello(input)
+	if err != nil {
+		return nil, err
+	}
+	chain := c.route(hello)
+	if chain == nil {
+		return nil, NoRoute
+	}
+
+	md := pipeline.GetMetadata(ctx)
+	if md != nil && md.Destination == nil && hello.serverName != "" {
+		// lets a route end with a plain "tcp" stage to reach the
+		// requested host itself
+		port := 443
+		if local, ok := md.Local.(*net.TCPAddr); ok {
+			port = local.Port
+		}
+		md.Destination = &pipeline.Address{
+			Network: "tcp",
+			Host:    hello.serverName,
+			Port:    port,
+		}
+	}
+
+	p, err := pipeline.NewChain(ctx, chain, pipeline.NewReplay(raw, input))
+	if err != nil {
+		return nil, err
+	}
+	return &SNI{c, p}, nil
+}
+
+func (s *SNI) CloseWrite() error {
+	return pipeline.CloseWrite(s.Pipeline)
+}
+
+func init() {
+	config := &Config{}
+	pipeline.RegistePipelineCreator("sni", config)
+}
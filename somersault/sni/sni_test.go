@@ -0,0 +1,86 @@
+package sni
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	_ "github.com/gchange/somersault/somersault/direct"
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// TestInternalServerName sends a ClientHello naming localhost to an sni stage
+// routing to the host it names, it must not get through unless the listener
+// allows internal destinations. crypto/tls never sends an IP as the server
+// name, TestPermit covers the addresses themselves.
+func TestInternalServerName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	chain, err := pipeline.ParseChain([]interface{}{
+		map[string]interface{}{
+			"protocol": "sni",
+			"config": map[string]interface{}{
+				"routes": []interface{}{
+					map[string]interface{}{
+						"server_name": "*",
+						"pipeline":    []interface{}{map[string]interface{}{"protocol": "tcp"}},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopback := []*net.IPNet{
+		{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+		{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+	}
+	tests := []struct {
+		serverName string
+		policy     *pipeline.DestinationPolicy
+		forbidden  bool
+	}{
+		{"localhost", nil, true},
+		{"localhost", pipeline.DefaultDestinationPolicy, true},
+		{"localhost", &pipeline.DestinationPolicy{Deny: loopback, AllowInternal: true}, true},
+		{"localhost", &pipeline.DestinationPolicy{AllowInternal: true}, false},
+	}
+	for _, tt := range tests {
+		hello := records(captureHello(t, tt.serverName, []string{"h2", "http/1.1"}), 1<<14)
+		md := &pipeline.Metadata{
+			Local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			Policy: tt.policy,
+		}
+		ctx := pipeline.WithMetadata(context.Background(), md)
+		p, err := pipeline.NewChain(ctx, chain, input{bytes.NewReader(hello)})
+		if tt.forbidden {
+			if !errors.Is(err, pipeline.DestinationForbidden) {
+				t.Errorf("%s: error %v, want %v", tt.serverName, err, pipeline.DestinationForbidden)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s allowed: %v", tt.serverName, err)
+			continue
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package somersault
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+)
+
+// umaskLock keeps two listeners from changing the umask at once.
+var umaskLock sync.Mutex
+
+// withUmask runs f, creating a socket file, with the umask that gives the
+// file mode, so it never has a wider one.
+func withUmask(mode uint32, f func() error) error {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(int(0777 &^ mode))
+	defer syscall.Umask(old)
+	return f()
+}
+
+// isRefused tells whether dialing a socket file failed because nothing
+// listens on it.
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
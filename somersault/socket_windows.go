@@ -0,0 +1,20 @@
+package somersault
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeconnrefused is what windows returns dialing a socket nobody listens
+// on.
+const wsaeconnrefused = syscall.Errno(10061)
+
+// withUmask runs f, windows has no umask and leaves the socket file to the
+// ACL of its directory.
+func withUmask(mode uint32, f func() error) error {
+	return f()
+}
+
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, wsaeconnrefused)
+}
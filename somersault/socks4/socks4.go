@@ -0,0 +1,143 @@
+package socks4
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const (
+	socksVersion = 4
+
+	cmdConnect = 1
+
+	replyGranted  = 0x5a
+	replyRejected = 0x5b
+
+	maxFieldLength = 255
+)
+
+var (
+	UnsupportedProtocol = errors.New("unsupported protocol")
+	UnsupportedCommand  = errors.New("unsupported command")
+	FieldTooLong        = errors.New("field too long")
+)
+
+// Config is a socks4 and socks4a server, only CONNECT is supported.
+type Config struct {
+	Network string `somersault:"network"`
+}
+
+type Socks4 struct {
+	*Config
+	*pipeline.DefaultPipeline
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{
+		Network: c.Network,
+	}
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	if input == nil {
+		return nil, errors.New("input not found")
+	}
+	output, err := c.HandshakeReply(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	dp, err := pipeline.NewDefaultPipeline(ctx, input, output)
+	if err != nil {
+		return nil, err
+	}
+	s := &Socks4{
+		c,
+		dp,
+	}
+	pipeline.Go(ctx, s.Transport)
+	return s, nil
+}
+
+func readString(input pipeline.Pipeline) (string, error) {
+	buf := make([]byte, 0, 16)
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(input, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= maxFieldLength {
+			return "", FieldTooLong
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+func (c *Config) HandshakeReply(ctx context.Context, input pipeline.Pipeline) (net.Conn, error) {
+	req := struct {
+		Version uint8
+		Command uint8
+		Port    uint16
+		IP      [4]byte
+	}{}
+	err := binary.Read(input, binary.BigEndian, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Version != socksVersion {
+		return nil, UnsupportedProtocol
+	}
+	// the user id is not checked
+	_, err = readString(input)
+	if err != nil {
+		return nil, err
+	}
+
+	host := net.IP(req.IP[:]).String()
+	if req.IP[0] == 0 && req.IP[1] == 0 && req.IP[2] == 0 && req.IP[3] != 0 {
+		// socks4a, the client left name resolution to us
+		host, err = readString(input)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply := []byte{0, replyRejected, 0, 0, 0, 0, 0, 0}
+	if req.Command != cmdConnect {
+		input.Write(reply)
+		return nil, UnsupportedCommand
+	}
+	if md := pipeline.GetMetadata(ctx); md != nil {
+		md.Destination = &pipeline.Address{Network: c.Network, Host: host, Port: int(req.Port)}
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(req.Port)))
+	conn, err := pipeline.Dial(ctx, c.Network, addr)
+	if err != nil {
+		input.Write(reply)
+		return nil, err
+	}
+	reply[1] = replyGranted
+	_, err = input.Write(reply)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func init() {
+	config := &Config{
+		Network: "tcp",
+	}
+	pipeline.RegistePipelineCreator("socks4", config)
+}
@@ -1,18 +1,31 @@
 package socks5
 
 import (
+	"crypto/subtle"
+	"errors"
+	"io"
 	"sync"
 
 	"github.com/gchange/somersault/somersault/pipeline"
 )
 
+const (
+	methodNoAuth       = 0
+	methodUserPass     = 2
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 1
+)
+
 var (
-	authMethods      = map[uint8]func(pipeline.Pipeline) error{}
-	authReplyMethods = map[uint8]func(pipeline.Pipeline) error{}
+	authMethods      = map[uint8]func(*Config, pipeline.Pipeline) error{}
+	authReplyMethods = map[uint8]func(*Config, pipeline.Pipeline) (string, error){}
 	authMethodLock   = sync.RWMutex{}
+
+	AuthFailed = errors.New("authentication failed")
 )
 
-func registeAuthMethod(method uint8, f func(pipeline.Pipeline) error) error {
+func registeAuthMethod(method uint8, f func(*Config, pipeline.Pipeline) error) error {
 	authMethodLock.Lock()
 	defer authMethodLock.Unlock()
 	if _, ok := authMethods[method]; ok {
@@ -22,7 +35,7 @@ func registeAuthMethod(method uint8, f func(pipeline.Pipeline) error) error {
 	return nil
 }
 
-func getAuthMethod(method uint8) func(pipeline.Pipeline) error {
+func getAuthMethod(method uint8) func(*Config, pipeline.Pipeline) error {
 	authMethodLock.RLock()
 	defer authMethodLock.RUnlock()
 	if f, ok := authMethods[method]; ok {
@@ -34,14 +47,14 @@ func getAuthMethod(method uint8) func(pipeline.Pipeline) error {
 func getSupportAuthMethod() []uint8 {
 	authMethodLock.RLock()
 	defer authMethodLock.RUnlock()
-	methods := make([]uint8, len(authMethods))
+	methods := make([]uint8, 0, len(authMethods))
 	for method := range authMethods {
 		methods = append(methods, method)
 	}
 	return methods
 }
 
-func registeAuthReplyMethod(method uint8, f func(pipeline.Pipeline) error) error {
+func registeAuthReplyMethod(method uint8, f func(*Config, pipeline.Pipeline) (string, error)) error {
 	authMethodLock.Lock()
 	defer authMethodLock.Unlock()
 	if _, ok := authReplyMethods[method]; ok {
@@ -51,7 +64,7 @@ func registeAuthReplyMethod(method uint8, f func(pipeline.Pipeline) error) error
 	return nil
 }
 
-func getAuthReplyMethod(method uint8) func(pipeline.Pipeline) error {
+func getAuthReplyMethod(method uint8) func(*Config, pipeline.Pipeline) (string, error) {
 	authMethodLock.RLock()
 	defer authMethodLock.RUnlock()
 	if f, ok := authReplyMethods[method]; ok {
@@ -60,11 +73,115 @@ func getAuthReplyMethod(method uint8) func(pipeline.Pipeline) error {
 	return nil
 }
 
-func noAuth(_ pipeline.Pipeline) error {
+// authMethods lists the methods offered to a server, credentials are only
+// offered when configured.
+func (c *Config) authMethods() []uint8 {
+	methods := make([]uint8, 0, 2)
+	for _, method := range getSupportAuthMethod() {
+		if method == methodUserPass && c.Username == "" {
+			continue
+		}
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// selectAuthMethod picks the method a client has to use, a server with
+// users only accepts username/password.
+func (c *Config) selectAuthMethod(methods []uint8) uint8 {
+	var want uint8 = methodNoAuth
+	if len(c.Users) != 0 {
+		want = methodUserPass
+	}
+	for _, method := range methods {
+		if method == want {
+			return want
+		}
+	}
+	return methodNoAcceptable
+}
+
+func noAuth(_ *Config, _ pipeline.Pipeline) error {
+	return nil
+}
+
+func noAuthReply(_ *Config, _ pipeline.Pipeline) (string, error) {
+	return "", nil
+}
+
+// userPass is the client side of RFC 1929.
+func userPass(c *Config, input pipeline.Pipeline) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return AuthFailed
+	}
+	req := []byte{userPassVersion, uint8(len(c.Username))}
+	req = append(req, c.Username...)
+	req = append(req, uint8(len(c.Password)))
+	req = append(req, c.Password...)
+	_, err := input.Write(req)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(input, resp)
+	if err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return AuthFailed
+	}
 	return nil
 }
 
+func readField(input pipeline.Pipeline) (string, error) {
+	l := make([]byte, 1)
+	_, err := io.ReadFull(input, l)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, l[0])
+	_, err = io.ReadFull(input, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// userPassReply is the server side of RFC 1929, it returns the user.
+func userPassReply(c *Config, input pipeline.Pipeline) (string, error) {
+	version := make([]byte, 1)
+	_, err := io.ReadFull(input, version)
+	if err != nil {
+		return "", err
+	}
+	if version[0] != userPassVersion {
+		return "", UnsupportedProtocol
+	}
+	user, err := readField(input)
+	if err != nil {
+		return "", err
+	}
+	password, err := readField(input)
+	if err != nil {
+		return "", err
+	}
+
+	want, ok := c.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(password)) != 1 {
+		input.Write([]byte{userPassVersion, 1})
+		return "", AuthFailed
+	}
+	_, err = input.Write([]byte{userPassVersion, 0})
+	if err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
 func init() {
-	registeAuthMethod(0, noAuth)
-	registeAuthReplyMethod(0, noAuth)
+	registeAuthMethod(methodNoAuth, noAuth)
+	registeAuthReplyMethod(methodNoAuth, noAuthReply)
+	registeAuthMethod(methodUserPass, userPass)
+	registeAuthReplyMethod(methodUserPass, userPassReply)
 }
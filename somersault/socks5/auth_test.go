@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// conn reads the request in r and records the replies.
+type conn struct {
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *conn) Read(buf []byte) (int, error)  { return c.r.Read(buf) }
+func (c *conn) Write(buf []byte) (int, error) { return c.w.Write(buf) }
+func (c *conn) Close() error                  { return nil }
+
+func userPassRequest(user, password string) []byte {
+	req := []byte{userPassVersion, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	return append(req, password...)
+}
+
+func TestUsersDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		users interface{}
+		want  string
+		ok    bool
+	}{
+		{"string", map[string]interface{}{"alice": "s3cret"}, "s3cret", true},
+		{"json number", map[string]interface{}{"alice": json.Number("1234")}, "1234", true},
+		{"yaml int", map[string]interface{}{"alice": 1234}, "1234", true},
+		{"object", map[string]interface{}{"alice": map[string]interface{}{"x": 1}}, "", false},
+		{"list", map[string]interface{}{"alice": []interface{}{"a"}}, "", false},
+	}
+	for _, tt := range tests {
+		c := &Config{}
+		err := pipeline.Decode(c, map[string]interface{}{"users": tt.users})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if tt.ok && c.Users["alice"] != tt.want {
+			t.Errorf("%s: password %q, want %q", tt.name, c.Users["alice"], tt.want)
+		}
+	}
+}
+
+func TestUserPassReply(t *testing.T) {
+	c := &Config{Users: map[string]string{"alice": "1234"}}
+	tests := []struct {
+		name     string
+		request  []byte
+		user     string
+		err      error
+		response []byte
+	}{
+		{"accepted", userPassRequest("alice", "1234"), "alice", nil, []byte{userPassVersion, 0}},
+		{"wrong password", userPassRequest("alice", "12345"), "", AuthFailed, []byte{userPassVersion, 1}},
+		{"unknown user", userPassRequest("bob", "1234"), "", AuthFailed, []byte{userPassVersion, 1}},
+		{"empty password", userPassRequest("alice", ""), "", AuthFailed, []byte{userPassVersion, 1}},
+		{"bad version", append([]byte{5}, userPassRequest("alice", "1234")[1:]...), "", UnsupportedProtocol, nil},
+	}
+	for _, tt := range tests {
+		input := &conn{r: bytes.NewReader(tt.request)}
+		user, err := userPassReply(c, input)
+		if err != tt.err || user != tt.user {
+			t.Errorf("%s: got %q, %v", tt.name, user, err)
+		}
+		if !bytes.Equal(input.w.Bytes(), tt.response) {
+			t.Errorf("%s: replied %v, want %v", tt.name, input.w.Bytes(), tt.response)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 
 	"github.com/gchange/somersault/somersault/pipeline"
 )
@@ -17,7 +18,12 @@ type Config struct {
 	Network string `somersault:"network"`
 	Address string `somersault:"address"`
 	Port    uint16 `somersault:"port"`
-	Reverse uint8
+	Reverse uint8  `somersault:"-"`
+	// Users maps the user names a server accepts to their passwords,
+	// Username and Password are sent to an upstream server.
+	Users    map[string]string `somersault:"users"`
+	Username string            `somersault:"username"`
+	Password string            `somersault:"password"`
 }
 
 type Socks5 struct {
@@ -27,11 +33,14 @@ type Socks5 struct {
 
 func (c *Config) DeepCopy() pipeline.Config {
 	return &Config{
-		Command: c.Command,
-		Network: c.Network,
-		Address: c.Address,
-		Port:    c.Port,
-		Reverse: c.Reverse,
+		Command:  c.Command,
+		Network:  c.Network,
+		Address:  c.Address,
+		Port:     c.Port,
+		Reverse:  c.Reverse,
+		Users:    c.Users,
+		Username: c.Username,
+		Password: c.Password,
 	}
 }
 
@@ -39,7 +48,18 @@ func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipe
 	if input == nil {
 		return nil, errors.New("input not found")
 	}
-	output, err := c.HandshakeReply(input)
+	var err error
+	if md := pipeline.GetMetadata(ctx); md != nil && md.Destination != nil {
+		// the destination is already known, e.g. from a redirect inbound,
+		// so act as a client of the configured server
+		var command uint8 = cmdConnect
+		if md.Destination.Network == "udp" {
+			command = cmdUDPAssociate
+		}
+		output, err = c.Connect(ctx, command, md.Destination.Host, uint16(md.Destination.Port))
+	} else {
+		output, err = c.HandshakeReply(ctx, input)
+	}
 	fmt.Println(output, err)
 	if err != nil {
 		return nil, err
@@ -52,87 +72,95 @@ func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipe
 		c,
 		dp,
 	}
-	go s.Transport()
+	pipeline.Go(ctx, s.Transport)
 	return s, nil
 }
 
-func (c *Config) Connect(command uint8, address string, port uint16) (net.Conn, error) {
+// Connect reaches address through the configured server, or directly
+// within the destination policy of ctx without one.
+func (c *Config) Connect(ctx context.Context, command uint8, address string, port uint16) (net.Conn, error) {
 	fmt.Println(command, address, port, "server info", c.Address, c.Port)
 	if c.Address != "" && c.Port != 0 {
-		return c.ConnectToServer(command, address, port)
+		return c.ConnectToServer(ctx, command, address, port)
 	}
 	network := ""
 	switch command {
-	case 1:
+	case cmdConnect:
 		network = "tcp"
-	case 2:
+	case cmdBind:
 		return nil, UnsupportedCommand
-	case 3:
+	case cmdUDPAssociate:
 		network = "udp"
 	default:
 		return nil, UnsupportedCommand
 	}
-	addr := fmt.Sprintf("%s:%d", address, port)
+	addr := net.JoinHostPort(address, strconv.Itoa(int(port)))
 	fmt.Println(addr)
-	conn, err := net.Dial(network, addr)
+	conn, err := pipeline.Dial(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 	return conn, nil
 }
 
-func (c *Config) ConnectToServer(command uint8, address string, port uint16) (net.Conn, error) {
+func (c *Config) ConnectToServer(ctx context.Context, command uint8, address string, port uint16) (net.Conn, error) {
 	fmt.Println("connect to server", command, address, port)
-	addr := fmt.Sprintf("%s:%d", c.Address, c.Port)
-	conn, err := net.Dial(c.Network, addr)
+	addr := net.JoinHostPort(c.Address, strconv.Itoa(int(c.Port)))
+	conn, err := pipeline.Dialer(ctx).DialContext(ctx, c.Network, addr)
 	if err != nil {
 		return nil, err
 	}
-	err = c.Handshake(conn, command, address, port)
+	if command == cmdUDPAssociate {
+		return c.associate(ctx, conn, address, port)
+	}
+	_, _, err = c.Handshake(conn, command, address, port)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	return conn, nil
 }
 
-func (c *Config) Handshake(input pipeline.Pipeline, command uint8, address string, port uint16) error {
-	methods := getSupportAuthMethod()
+// Handshake negotiates command with a socks5 server and returns the address
+// the server bound for it.
+func (c *Config) Handshake(input pipeline.Pipeline, command uint8, address string, port uint16) (string, uint16, error) {
+	methods := c.authMethods()
 	_, err := input.Write([]byte{socksVersion, uint8(len(methods))})
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 	_, err = input.Write(methods)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
 	var version uint8
 	var method uint8
 	err = binary.Read(input, binary.BigEndian, &version)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 	err = binary.Read(input, binary.BigEndian, &method)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
 	if !isValidVersion(version) {
-		return UnsupportedProtocol
+		return "", 0, UnsupportedProtocol
 	}
 
 	f := getAuthMethod(method)
 	if f == nil {
-		return UnsupportedAuthMethod
+		return "", 0, UnsupportedAuthMethod
 	}
-	err = f(input)
+	err = f(c, input)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
 	_, err = input.Write([]byte{socksVersion, command, c.Reverse})
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
 	addressType := addrTypeDomain
@@ -141,30 +169,30 @@ func (c *Config) Handshake(input pipeline.Pipeline, command uint8, address strin
 		addressType := addrTypeIPv4
 		_, err = input.Write([]byte{uint8(addressType)})
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 		_, err = input.Write(ip)
 	} else if ip := ip.To16(); ip != nil {
 		addressType := addrTypeIPv6
 		_, err = input.Write([]byte{uint8(addressType)})
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 		_, err = input.Write(ip)
 	} else {
 		_, err = input.Write([]byte{uint8(addressType), uint8(len(address))})
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 		_, err = input.Write([]byte(address))
 	}
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
 	err = binary.Write(input, binary.BigEndian, &port)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
 	resp := struct {
@@ -175,13 +203,13 @@ func (c *Config) Handshake(input pipeline.Pipeline, command uint8, address strin
 	}{}
 	err = binary.Read(input, binary.BigEndian, &resp)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 	if !isValidVersion(resp.Version) {
-		return UnsupportedProtocol
+		return "", 0, UnsupportedProtocol
 	}
 	if resp.Response != 0 {
-		return errors.New("connect failed")
+		return "", 0, errors.New("connect failed")
 	}
 	var ipLen uint8
 	switch resp.AddressType {
@@ -192,25 +220,28 @@ func (c *Config) Handshake(input pipeline.Pipeline, command uint8, address strin
 	case addrTypeDomain:
 		err = binary.Read(input, binary.BigEndian, &ipLen)
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 	default:
-		return UnsupportedCommand
+		return "", 0, UnsupportedCommand
 	}
 	ipBuf := make([]byte, ipLen)
 	_, err = io.ReadFull(input, ipBuf)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 	var remotePort uint16
 	err = binary.Read(input, binary.BigEndian, &remotePort)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
-	return nil
+	if resp.AddressType == addrTypeDomain {
+		return string(ipBuf), remotePort, nil
+	}
+	return net.IP(ipBuf).String(), remotePort, nil
 }
 
-func (c *Config) HandshakeReply(input pipeline.Pipeline) (pipeline.Pipeline, error) {
+func (c *Config) HandshakeReply(ctx context.Context, input pipeline.Pipeline) (pipeline.Pipeline, error) {
 	var version uint8
 	var nMethod uint8
 	err := binary.Read(input, binary.BigEndian, &version)
@@ -226,10 +257,13 @@ func (c *Config) HandshakeReply(input pipeline.Pipeline) (pipeline.Pipeline, err
 	}
 
 	methods := make([]byte, nMethod)
-	_, err = input.Read(methods)
+	_, err = io.ReadFull(input, methods)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println(version, methods)
-	var method uint8 = 0
+	method := c.selectAuthMethod(methods)
 	_, err = input.Write([]byte{version, method})
 	if err != nil {
 		return nil, err
@@ -239,10 +273,16 @@ func (c *Config) HandshakeReply(input pipeline.Pipeline) (pipeline.Pipeline, err
 	if f == nil {
 		return nil, UnsupportedAuthMethod
 	}
-	err = f(input)
+	user, err := f(c, input)
 	if err != nil {
 		return nil, err
 	}
+	if md := pipeline.GetMetadata(ctx); md != nil {
+		err = md.SetUser(user)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	req := struct {
 		Version     uint8
@@ -303,26 +343,39 @@ func (c *Config) HandshakeReply(input pipeline.Pipeline) (pipeline.Pipeline, err
 		return nil, err
 	}
 
-	conn, err := c.Connect(req.Command, string(remoteAddr), remotePort)
+	conn, err := c.Connect(ctx, req.Command, string(remoteAddr), remotePort)
 	fmt.Println(conn, err)
 	if err != nil {
+		var reply uint8 = replyFailure
+		if errors.Is(err, pipeline.DestinationForbidden) {
+			reply = replyNotAllowed
+		}
+		input.Write([]byte{req.Version, reply, req.Reverse, addrTypeIPv4, 0, 0, 0, 0, 0, 0})
 		return nil, err
 	}
 
-	localAddr := conn.RemoteAddr().(*net.TCPAddr)
+	// the bound address, all zeros for an upstream without an ip one like
+	// a unix socket
+	boundIP, boundPort := net.IPv4zero, 0
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		boundIP, boundPort = addr.IP, addr.Port
+	case *net.UDPAddr:
+		boundIP, boundPort = addr.IP, addr.Port
+	}
 	var localIP []byte
 	var localAddrType uint8
-	if ip := localAddr.IP.To4(); ip != nil {
+	if ip := boundIP.To4(); ip != nil {
 		localIP = ip
 		localAddrType = addrTypeIPv4
-	} else if ip := localAddr.IP.To16(); ip != nil {
+	} else if ip := boundIP.To16(); ip != nil {
 		localIP = ip
 		localAddrType = addrTypeIPv6
 	} else {
-		localIP = localAddr.IP
+		localIP = boundIP
 		localAddrType = addrTypeDomain
 	}
-	log.Println(localAddr, len(localAddr.IP))
+	log.Println(conn.RemoteAddr(), len(boundIP))
 	_, err = input.Write([]byte{req.Version, 0, req.Reverse, localAddrType})
 	if err != nil {
 		return nil, err
@@ -341,7 +394,7 @@ func (c *Config) HandshakeReply(input pipeline.Pipeline) (pipeline.Pipeline, err
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Write(input, binary.BigEndian, uint16(localAddr.Port))
+	err = binary.Write(input, binary.BigEndian, uint16(boundPort))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var (
+	FragmentedPacket = errors.New("fragmented udp packets are not supported")
+	ShortPacket      = errors.New("udp packet too short")
+)
+
+// udpConn sends datagrams for one destination through a socks5 udp relay,
+// the association lives as long as the tcp control connection.
+type udpConn struct {
+	net.Conn
+	control net.Conn
+	header  []byte
+	once    sync.Once
+}
+
+func (c *Config) associate(ctx context.Context, control net.Conn, address string, port uint16) (net.Conn, error) {
+	host, relayPort, err := c.Handshake(control, cmdUDPAssociate, "0.0.0.0", 0)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		// the relay listens on every address of the server
+		host = c.Address
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(relayPort)))
+	conn, err := pipeline.Dialer(ctx).DialContext(ctx, "udp", addr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	u := &udpConn{
+		Conn:    conn,
+		control: control,
+		header:  appendAddress([]byte{0, 0, 0}, address, port),
+	}
+	pipeline.Go(ctx, func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := control.Read(buf); err != nil {
+				u.Close()
+				return
+			}
+		}
+	})
+	return u, nil
+}
+
+func (u *udpConn) Read(buf []byte) (int, error) {
+	packet := make([]byte, 65535)
+	for {
+		n, err := u.Conn.Read(packet)
+		if err != nil {
+			return 0, err
+		}
+		payload, err := parseUDPHeader(packet[:n])
+		if err != nil {
+			// not worth tearing the association down for
+			continue
+		}
+		return copy(buf, payload), nil
+	}
+}
+
+func (u *udpConn) Write(buf []byte) (int, error) {
+	packet := make([]byte, 0, len(u.header)+len(buf))
+	packet = append(packet, u.header...)
+	packet = append(packet, buf...)
+	_, err := u.Conn.Write(packet)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (u *udpConn) Close() error {
+	var err error
+	u.once.Do(func() {
+		u.control.Close()
+		err = u.Conn.Close()
+	})
+	return err
+}
+
+func appendAddress(buf []byte, address string, port uint16) []byte {
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, addrTypeIPv4)
+		buf = append(buf, ip4...)
+	} else if ip != nil {
+		buf = append(buf, addrTypeIPv6)
+		buf = append(buf, ip.To16()...)
+	} else {
+		buf = append(buf, addrTypeDomain, uint8(len(address)))
+		buf = append(buf, address...)
+	}
+	return binary.BigEndian.AppendUint16(buf, port)
+}
+
+// parseUDPHeader strips RSV, FRAG, ATYP, DST.ADDR and DST.PORT.
+func parseUDPHeader(packet []byte) ([]byte, error) {
+	if len(packet) < 4 {
+		return nil, ShortPacket
+	}
+	if packet[2] != 0 {
+		return nil, FragmentedPacket
+	}
+	offset := 4
+	switch packet[3] {
+	case addrTypeIPv4:
+		offset += net.IPv4len
+	case addrTypeIPv6:
+		offset += net.IPv6len
+	case addrTypeDomain:
+		if len(packet) < 5 {
+			return nil, ShortPacket
+		}
+		offset += 1 + int(packet[4])
+	default:
+		return nil, UnknownAddrType
+	}
+	offset += 2
+	if len(packet) < offset {
+		return nil, ShortPacket
+	}
+	return packet[offset:], nil
+}
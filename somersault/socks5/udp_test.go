@@ -0,0 +1,38 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUDPHeader(t *testing.T) {
+	for _, address := range []string{"10.0.0.1", "2001:db8::1", "example.com"} {
+		packet := appendAddress([]byte{0, 0, 0}, address, 53)
+		packet = append(packet, "payload"...)
+		payload, err := parseUDPHeader(packet)
+		if err != nil {
+			t.Errorf("%s: %s", address, err)
+		} else if !bytes.Equal(payload, []byte("payload")) {
+			t.Errorf("%s: payload %q", address, payload)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"short", []byte{0, 0, 0}, ShortPacket},
+		{"fragment", []byte{0, 0, 1, addrTypeIPv4, 10, 0, 0, 1, 0, 53}, FragmentedPacket},
+		{"address type", []byte{0, 0, 0, 9, 10, 0, 0, 1, 0, 53}, UnknownAddrType},
+		{"short ipv4", []byte{0, 0, 0, addrTypeIPv4, 10, 0, 0, 1, 0}, ShortPacket},
+		{"short domain", []byte{0, 0, 0, addrTypeDomain}, ShortPacket},
+		{"domain length", []byte{0, 0, 0, addrTypeDomain, 11, 'e', 'x'}, ShortPacket},
+	}
+	for _, tt := range tests {
+		_, err := parseUDPHeader(tt.packet)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -4,17 +4,25 @@ import "errors"
 
 const (
 	socksVersion = 5
-	addrTypeIPv4 = 1
+
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
+
+	addrTypeIPv4   = 1
 	addrTypeDomain = 3
-	addrTypeIPv6 = 4
+	addrTypeIPv6   = 4
+
+	replyFailure    = 1
+	replyNotAllowed = 2
 )
 
 var (
-	UnsupportedProtocol = errors.New("unsupported protocol")
-	DuplicateAuthMethod = errors.New("duplicate auth method")
+	UnsupportedProtocol   = errors.New("unsupported protocol")
+	DuplicateAuthMethod   = errors.New("duplicate auth method")
 	UnsupportedAuthMethod = errors.New("unsupported auth method")
-	UnsupportedCommand = errors.New("unsupported command")
-	UnknownAddrType = errors.New("unknown address type")
+	UnsupportedCommand    = errors.New("unsupported command")
+	UnknownAddrType       = errors.New("unknown address type")
 )
 
 func isValidVersion(version uint8) bool {
@@ -2,143 +2,549 @@ package somersault
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"reflect"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gchange/somersault/somersault/pipeline"
+	"github.com/gchange/somersault/somersault/proxyproto"
 )
 
+const (
+	defaultGracePeriod = 30 * time.Second
+	minAcceptDelay     = 5 * time.Millisecond
+	maxAcceptDelay     = time.Second
+)
+
+// Unowned is a chain returning without any stage taking the connection.
+var Unowned = errors.New("no stage took the connection")
+
 type Config struct {
-	Config []map[string]interface{} `json:"config"`
+	Config  []*Listener  `json:"config"`
+	Forward []Forward    `json:"forward"`
+	Quota   *QuotaConfig `json:"quota"`
+	Admin   *AdminConfig `json:"admin"`
+	// GracePeriod is how long Close lets connections finish, 30s by
+	// default.
+	GracePeriod *pipeline.Duration `json:"grace_period"`
 }
 
 type Somerasult struct {
 	*Config
-	logger *log.Logger
+	logger   *log.Logger
+	services []*service
+	// attached are the listeners stages opened, see attach
+	attached map[*service]struct{}
+	lock     sync.Mutex
+	quota    *quota
+	admin    *http.Server
+	// adminListener is handed over on upgrade, as adminAddress
+	adminListener net.Listener
+	adminAddress  string
+	grace         time.Duration
+	closing       bool
+	conns         map[*trackedConn]*service
+	active        sync.WaitGroup
+	loops         sync.WaitGroup
+	load          func() (*Config, error)
+	// reloading runs one Apply at a time
+	reloading sync.Mutex
+	// handlers are the serve goroutines and the relays their stages start,
+	// they run under ctx, cancelled once the connections are gone
+	handlers sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// service is a listener with the route serving its connections.
+type service struct {
+	net.Listener
+	addr string
+	// key and signature tell on reload whether the listener stays, see
+	// plan
+	key       string
+	signature string
+	// entry it was started from, to start it again when a reload fails
+	entry *entry
+	lock  sync.Mutex
+	route *route
+}
+
+// route is how a listener serves a connection, a reload swaps it for the
+// connections accepted afterwards.
+type route struct {
+	chain         []pipeline.Config
+	proxyProtocol bool
+	trusted       *cidrList
+	acl           *acl
+	policy        *pipeline.DestinationPolicy
+	timeouts      pipeline.Timeouts
+	bufferSize    int
+	admission     *admission
+}
+
+func (srv *service) current() *route {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.route
+}
+
+func (srv *service) swap(r *route) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.route = r
 }
 
 func (c *Config) New(logger *log.Logger) (*Somerasult, error) {
 	s := Somerasult{
-		c,
-		logger,
+		Config:   c,
+		logger:   logger,
+		grace:    defaultGracePeriod,
+		conns:    make(map[*trackedConn]*service),
+		attached: make(map[*service]struct{}),
+	}
+	ctx := pipeline.WithLogger(context.Background(), logger)
+	s.ctx, s.cancel = context.WithCancel(pipeline.WithGroup(ctx, &s.handlers))
+	if c.GracePeriod != nil {
+		s.grace = time.Duration(*c.GracePeriod)
+	}
+	if c.Quota != nil {
+		q, err := c.Quota.New(logger)
+		if err != nil {
+			s.cancel()
+			return nil, err
+		}
+		s.quota = q
+	}
+	entries, err := c.entries()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	for _, l := range entries {
+		err := s.init(l)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
-	s.logger.Println(c.Config, c)
-	for _, config := range c.Config {
-		err := s.init(config)
+	if c.Admin != nil {
+		err := s.serveAdmin(c.Admin)
 		if err != nil {
 			s.Close()
 			return nil, err
 		}
 	}
+	closeInherited()
+	notifyParent()
 	return &s, nil
 }
 
-func (s *Somerasult) parseBaseConfig(m map[string]interface{}) (string, string, int) {
-	protocol, ok := getStringFromMap(m, "network")
-	if !ok {
-		protocol = "tcp"
+func (s *Somerasult) init(l *Listener) error {
+	e, err := s.plan(l)
+	if err != nil {
+		return err
+	}
+	return s.start(e)
+}
+
+// entry is a listener ready to be started.
+type entry struct {
+	network   string
+	address   string
+	port      int
+	addr      string
+	key       string
+	signature string
+	listener  *Listener
+	route     *route
+}
+
+// plan checks a listener and builds its route, errors locate the
+// offending option in the config.
+func (s *Somerasult) plan(l *Listener) (*entry, error) {
+	network, addr := l.socket()
+	chain, err := l.parse()
+	if err != nil {
+		return nil, pipeline.FieldError(l.path, err)
+	}
+	r, err := s.parseRoute(l, chain)
+	if err != nil {
+		return nil, pipeline.FieldError(l.path, err)
+	}
+	key, err := l.key()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := listenSignature(l)
+	if err != nil {
+		return nil, err
 	}
+	return &entry{
+		network:   network,
+		address:   l.Address,
+		port:      l.Port,
+		addr:      addr,
+		key:       key,
+		signature: signature,
+		listener:  l,
+		route:     r,
+	}, nil
+}
 
-	address, ok := getStringFromMap(m, "address")
-	if !ok {
-		address = ""
+func (s *Somerasult) parseRoute(l *Listener, chain []pipeline.Config) (*route, error) {
+	acl, err := newACL(l, s.logger.Printf)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newDestinationPolicy(l)
+	if err != nil {
+		return nil, err
 	}
+	trusted, err := newCIDRList("proxy_trusted", l.ProxyTrusted, l.ProxyTrustedFile)
+	if err != nil {
+		return nil, err
+	}
+	return &route{
+		chain:         chain,
+		proxyProtocol: l.ProxyProtocol,
+		trusted:       trusted,
+		acl:           acl,
+		policy:        policy,
+		timeouts:      newTimeouts(l),
+		bufferSize:    int(l.BufferSize),
+		admission:     newAdmission(l),
+	}, nil
+}
 
-	port, ok := getIntFromMap(m, "port")
-	if !ok {
-		port = 0
+func (s *Somerasult) start(e *entry) error {
+	srv, err := s.bind(e)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		srv.Close()
+		return net.ErrClosed
 	}
-	return protocol, address, port
+	s.services = append(s.services, srv)
+	s.loops.Add(1)
+	s.lock.Unlock()
+
+	go s.accept(srv)
+	return nil
 }
 
-func (s *Somerasult) parseChainConfig(m map[string]interface{}) []pipeline.Config {
-	ps, ok := m["pipeline"]
-	if !ok {
-		return nil
+// bind opens the listener of e, its connections are not accepted yet.
+func (s *Somerasult) bind(e *entry) (*service, error) {
+	s.logger.Printf("create server listen %s\n", e.addr)
+	listener, err := s.inherit(e)
+	if listener == nil && err == nil {
+		listener, err = s.listen(e)
 	}
-	pcs, ok := ps.([]interface{})
-	if !ok {
-		return nil
+	if err != nil {
+		s.logger.Println(err)
+		return nil, err
 	}
-	if len(pcs) == 0 {
-		return nil
+	return &service{
+		Listener:  listener,
+		addr:      e.addr,
+		key:       e.key,
+		signature: e.signature,
+		entry:     e,
+		route:     e.route,
+	}, nil
+}
+
+// attach serves l, a listener a stage opened, with the route of parent
+// running chain. Its connections count against the limits of parent. It is
+// served until l is closed and closed along with the server.
+func (s *Somerasult) attach(parent *service, l net.Listener, chain []pipeline.Config) error {
+	r := *parent.current()
+	r.chain = chain
+	srv := &service{
+		Listener: l,
+		addr:     l.Addr().String(),
+		route:    &r,
+	}
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return net.ErrClosed
 	}
+	s.attached[srv] = struct{}{}
+	s.loops.Add(1)
+	s.lock.Unlock()
 
-	chain := make([]pipeline.Config, len(pcs))
-	for i, p := range pcs {
-		s.logger.Println(reflect.TypeOf(p))
-		p, ok := p.(map[string]interface{})
-		if !ok {
-			return nil
+	s.logger.Printf("%s serves %s\n", parent.addr, srv.addr)
+	go func() {
+		s.accept(srv)
+		s.lock.Lock()
+		delete(s.attached, srv)
+		s.lock.Unlock()
+	}()
+	return nil
+}
+
+// accept serves the connections of srv until its listener is closed,
+// backing off on errors like running out of file descriptors.
+func (s *Somerasult) accept(srv *service) {
+	defer s.loops.Done()
+	defer s.logger.Printf("close server on %s\n", srv.addr)
+	var delay time.Duration
+	for {
+		conn, err := srv.Accept()
+		s.logger.Println(conn, err, srv.addr)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			time.Sleep(delay)
+			continue
 		}
-		protocol, _ := getStringFromMap(p, "protocol")
-		config, ok := p["config"]
-		s.logger.Println(config, ok)
+		delay = 0
+		tc, ok := s.track(srv, conn)
 		if !ok {
-			return nil
+			conn.Close()
+			return
 		}
-		cs, ok := config.(map[string]interface{})
-		s.logger.Println(cs, ok)
-		if !ok {
-			return nil
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.serve(s.ctx, srv, tc)
+		}()
+	}
+}
+
+// track registers conn until it is closed, so Close can wait for it.
+func (s *Somerasult) track(srv *service, conn net.Conn) (*trackedConn, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return nil, false
+	}
+	tc := &trackedConn{Conn: conn}
+	tc.atClose(func() {
+		s.lock.Lock()
+		delete(s.conns, tc)
+		s.lock.Unlock()
+		s.active.Done()
+	})
+	s.conns[tc] = srv
+	s.active.Add(1)
+	return tc, true
+}
+
+// serve runs the chain of srv on tc. The acl is checked first, on the
+// client a PROXY header names when the listener expects one. Only trusted
+// peers may send that header, a client could name any source otherwise.
+// The connection is closed unless a stage of the chain took it over.
+func (s *Somerasult) serve(ctx context.Context, srv *service, tc *trackedConn) {
+	var conn net.Conn = tc
+	r := srv.current()
+	if r.proxyProtocol {
+		if !trustProxy(r.trusted, conn.RemoteAddr(), s.logger.Printf) {
+			s.logger.Printf("%s refuse %s: %s\n", srv.addr, conn.RemoteAddr(), UntrustedProxy)
+			conn.Close()
+			return
 		}
-		c, err := pipeline.GetPipelineCreator(protocol, cs)
-		s.logger.Println(c, err)
+		pc, err := proxyproto.Accept(conn)
 		if err != nil {
-			return nil
+			s.logger.Println(conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+
+	err := r.acl.check(conn.RemoteAddr())
+	if err != nil {
+		s.logger.Printf("%s refuse %s: %s\n", srv.addr, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	ip := sourceIP(conn.RemoteAddr())
+	err = r.admission.admit(ip)
+	if err != nil {
+		s.logger.Printf("%s refuse %s: %s\n", srv.addr, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	var user string
+	var userLock sync.Mutex
+	if s.quota != nil {
+		conn = &meteredConn{
+			Conn: conn,
+			account: func(upload, download int) {
+				userLock.Lock()
+				u := user
+				userLock.Unlock()
+				s.quota.add(u, upload, download)
+			},
+		}
+	}
+	metered := conn
+	var lifetime *time.Timer
+	if r.timeouts.Lifetime > 0 {
+		lifetime = time.AfterFunc(r.timeouts.Lifetime, func() { metered.Close() })
+	}
+	tc.atClose(func() {
+		if lifetime != nil {
+			lifetime.Stop()
 		}
-		chain[i] = c
+		r.admission.release(ip)
+		userLock.Lock()
+		r.admission.releaseUser(user)
+		if s.quota != nil {
+			s.quota.release(user, metered)
+		}
+		userLock.Unlock()
+	})
+
+	md := &pipeline.Metadata{
+		Listener:   srv.Addr(),
+		Source:     conn.RemoteAddr(),
+		Local:      conn.LocalAddr(),
+		Policy:     r.policy,
+		Timeouts:   r.timeouts,
+		BufferSize: r.bufferSize,
+		Serve: func(l net.Listener, chain []pipeline.Config) error {
+			return s.attach(srv, l, chain)
+		},
 	}
-	return chain
+	md.OnUser(func(u string) error {
+		err := r.admission.admitUser(u)
+		if err != nil {
+			s.logger.Printf("%s refuse %s as %s: %s\n", srv.addr, conn.RemoteAddr(), u, err)
+			return err
+		}
+		if s.quota != nil {
+			err = s.quota.admit(u, metered)
+			if err != nil {
+				r.admission.releaseUser(u)
+				s.logger.Printf("%s refuse %s as %s: %s\n", srv.addr, conn.RemoteAddr(), u, err)
+				return err
+			}
+		}
+		userLock.Lock()
+		r.admission.releaseUser(user)
+		if s.quota != nil {
+			s.quota.release(user, metered)
+		}
+		user = u
+		userLock.Unlock()
+		return nil
+	})
+	ctx = pipeline.WithMetadata(ctx, md)
+
+	if r.timeouts.Handshake > 0 {
+		conn.SetDeadline(time.Now().Add(r.timeouts.Handshake))
+	}
+	p, err := pipeline.NewChain(ctx, r.chain, conn)
+	s.logger.Println(conn, p, err)
+	if err == nil && (p == nil || p == pipeline.Pipeline(conn)) {
+		err = Unowned
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+}
+
+// Stats returns the connection counters of every listener.
+func (s *Somerasult) Stats() []ListenerStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := make([]ListenerStats, len(s.services))
+	for i, srv := range s.services {
+		r := srv.current()
+		stats[i] = r.admission.stats(srv.addr)
+		stats[i].Rejected[limitACL] = atomic.LoadUint64(&r.acl.denied)
+	}
+	return stats
 }
 
-func (s *Somerasult) init(config map[string]interface{}) error {
-	network, address, port := s.parseBaseConfig(config)
-	s.logger.Println(network, address, port)
-	if network == "" || address == "" || port == 0 {
+// Quota returns the traffic of every user, or of user alone when it is not
+// empty. It is nil without a quota config.
+func (s *Somerasult) Quota(user string) []UserQuota {
+	if s.quota == nil {
 		return nil
 	}
+	return s.quota.Quota(user)
+}
 
-	chain := s.parseChainConfig(config)
-	s.logger.Println(chain, config)
-	if chain == nil {
+// Close stops accepting, gives the open connections the grace period to
+// finish and closes the ones left. It returns once the goroutines serving
+// them are gone too.
+func (s *Somerasult) Close() error {
+	errs := &pipeline.Error{}
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
 		return nil
 	}
+	s.closing = true
+	services := append([]*service{}, s.services...)
+	for srv := range s.attached {
+		services = append(services, srv)
+	}
+	s.lock.Unlock()
 
-	addr := fmt.Sprintf("%s:%d", address, port)
-	s.logger.Printf("create server listen %s\n", addr)
-	listener, err := net.Listen(network, addr)
-	if err != nil {
-		s.logger.Println(err)
-		return err
+	for _, srv := range services {
+		if err := srv.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs.Append(fmt.Errorf("close %s: %s", srv.addr, err))
+		}
+	}
+	s.loops.Wait()
+	if s.admin != nil {
+		if err := s.admin.Close(); err != nil {
+			errs.Append(fmt.Errorf("close admin: %s", err))
+		}
 	}
 
-	var input pipeline.Pipeline
-	ctx := context.Background()
+	drained := make(chan struct{})
 	go func() {
-		defer s.logger.Printf("close server on %s\n", addr)
-		for {
-			conn, err := listener.Accept()
-			s.logger.Println(conn, err, chain)
-			if err != nil {
-				continue
-			}
-			input = conn
-			for _, c := range chain {
-				s.logger.Println(c)
-				input, err = c.New(ctx, input, nil)
-				s.logger.Println(c, conn, input, err)
-				if err != nil {
-					conn.Close()
-					continue
-				}
-			}
-		}
+		s.active.Wait()
+		close(drained)
 	}()
-	return nil
-}
+	timer := time.NewTimer(s.grace)
+	select {
+	case <-drained:
+		timer.Stop()
+	case <-timer.C:
+		s.lock.Lock()
+		conns := make([]*trackedConn, 0, len(s.conns))
+		for conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.lock.Unlock()
+		s.logger.Printf("grace period over, closing %d connections\n", len(conns))
+		for _, conn := range conns {
+			conn.Close()
+		}
+		<-drained
+	}
+	s.cancel()
+	s.handlers.Wait()
 
-func (s *Somerasult) Close() {
+	if s.quota != nil {
+		if err := s.quota.Close(); err != nil {
+			errs.Append(fmt.Errorf("save quota: %s", err))
+		}
+	}
+	if errs.IsNil() {
+		return nil
+	}
+	return errs
 }
@@ -0,0 +1,207 @@
+package somersault
+
+import (
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/gchange/somersault/somersault/direct"
+	_ "github.com/gchange/somersault/somersault/forward"
+)
+
+// echoServer echoes every connection until closed, close waits for its
+// goroutines.
+func echoServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		wg.Wait()
+	}
+}
+
+// freePort returns a tcp port nothing listens on right now.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return portOf(l.Addr())
+}
+
+func portOf(addr net.Addr) string {
+	return strconv.Itoa(addr.(*net.TCPAddr).Port)
+}
+
+// serverGoroutines returns the stacks of the goroutines running code of the
+// server, those of the tests aside.
+func serverGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	var stacks []string
+	for _, g := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+		if strings.Contains(g, "gchange/somersault/") && !strings.Contains(g, "_test.go") {
+			stacks = append(stacks, g)
+		}
+	}
+	return stacks
+}
+
+// leaked reports the goroutines running beyond the before there were.
+func leaked(t *testing.T, before int) {
+	t.Helper()
+	if got := runtime.NumGoroutine(); got > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines left, %d before\n%s", got, before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestCloseLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	target, stop := echoServer(t)
+	logger := log.New(io.Discard, "", 0)
+
+	c, err := ParseConfig([]byte(`{
+		"grace_period": "100ms",
+		"quota": {"file": "` + filepath.ToSlash(filepath.Join(t.TempDir(), "quota.json")) + `"},
+		"config": [{"address": "127.0.0.1", "port": ` + freePort(t) + `, "pipeline": ["tcp://` + target + `"]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.New(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.services[0].Addr().String()
+
+	// one connection done with, one still relaying when Close comes
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		buf := []byte("ping")
+		if _, err := conn.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	conns[0].Close()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close returned, nothing of the server may still run, the echo server
+	// stops once the relays closed their side
+	if stacks := serverGoroutines(); len(stacks) != 0 {
+		t.Errorf("running after Close:\n%s", strings.Join(stacks, "\n\n"))
+	}
+	stop()
+	leaked(t, before)
+}
+
+func TestNewFailureLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	c := &Config{
+		Config: []*Listener{nil},
+		Quota:  &QuotaConfig{File: filepath.Join(t.TempDir(), "quota.json")},
+	}
+	if _, err := c.New(log.New(io.Discard, "", 0)); err == nil {
+		t.Fatal("New accepted a nil listener")
+	}
+	leaked(t, before)
+}
+
+// TestForwardLoopback forwards to a target on loopback, which the
+// destination policy keeps clients from but the config may pin.
+func TestForwardLoopback(t *testing.T) {
+	target, stop := echoServer(t)
+	defer stop()
+	_, targetPort, _ := net.SplitHostPort(target)
+	a, b := freePort(t), freePort(t)
+	c, err := ParseConfig([]byte(`{"forward": [
+		{"listen": "127.0.0.1:` + a + `", "target": "` + target + `"},
+		{"listen": ":` + b + `", "target": ":` + targetPort + `"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.New(log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, port := range []string{a, b} {
+		if err := ping(net.JoinHostPort("127.0.0.1", port)); err != nil {
+			t.Errorf("forward on %s: %v", port, err)
+		}
+	}
+}
+
+// TestUnownedClosed runs a chain no stage of which takes the connection
+// over, the server has to close it and free its admission slot.
+func TestUnownedClosed(t *testing.T) {
+	c, err := ParseConfig([]byte(`{"config": [{"address": "127.0.0.1", "port": ` + freePort(t) + `,
+		"max_connections": 1, "pipeline": [{"protocol": "forward", "config": {"address": "127.0.0.1", "port": 9}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.New(log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.services[0].Addr().String()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if err != io.EOF {
+			t.Fatalf("connection %d: read error %v, want %v", i, err, io.EOF)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats()[0].Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still active", s.Stats()[0].Active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
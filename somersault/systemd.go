@@ -0,0 +1,54 @@
+package somersault
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemd socket activation, see sd_listen_fds(3). A listener entry with a
+// "name" takes the socket systemd opened with that FileDescriptorName
+// instead of listening itself.
+const listenFDsStart = 3
+
+var (
+	activateOnce sync.Once
+	activated    map[string][]*os.File
+)
+
+func loadActivated() {
+	activateOnce.Do(func() {
+		activated = make(map[string][]*os.File)
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if pid != os.Getpid() {
+			return
+		}
+		for i := 0; i < n; i++ {
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			f := os.NewFile(uintptr(listenFDsStart+i), name)
+			activated[name] = append(activated[name], f)
+		}
+	})
+}
+
+// takeActivated returns a socket systemd passed as name.
+func takeActivated(name string) *os.File {
+	loadActivated()
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+	files := activated[name]
+	if len(files) == 0 {
+		return nil
+	}
+	activated[name] = files[1:]
+	return files[0]
+}
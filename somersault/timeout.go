@@ -0,0 +1,39 @@
+package somersault
+
+import (
+	"time"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+const (
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultDialTimeout      = 30 * time.Second
+)
+
+// newTimeouts reads the timeouts of a listener, each a number of seconds or
+// a duration string, zero disables one:
+//
+//	handshake_timeout      until the chain is set up, 30s by default
+//	idle_timeout           both directions without data
+//	upload_idle_timeout    the client sends nothing
+//	download_idle_timeout  the client receives nothing
+//	dial_timeout           connecting to an outbound, 30s by default
+//	max_lifetime           since the connection was accepted
+func newTimeouts(l *Listener) pipeline.Timeouts {
+	t := pipeline.Timeouts{
+		Handshake:    defaultHandshakeTimeout,
+		Idle:         time.Duration(l.IdleTimeout),
+		UploadIdle:   time.Duration(l.UploadIdleTimeout),
+		DownloadIdle: time.Duration(l.DownloadIdleTimeout),
+		Dial:         defaultDialTimeout,
+		Lifetime:     time.Duration(l.MaxLifetime),
+	}
+	if l.HandshakeTimeout != nil {
+		t.Handshake = time.Duration(*l.HandshakeTimeout)
+	}
+	if l.DialTimeout != nil {
+		t.Dial = time.Duration(*l.DialTimeout)
+	}
+	return t
+}
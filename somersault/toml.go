@@ -0,0 +1,224 @@
+package somersault
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// tomlScanner walks toml the decoder already accepted to find where the
+// values are, which the decoder does not tell.
+type tomlScanner struct {
+	data      []byte
+	offset    int
+	locations map[string]location
+	// arrays counts the tables of the arrays of tables seen so far
+	arrays map[string]int
+}
+
+// tomlLocations maps the path of every value of the toml data to where it
+// starts, a table to its header.
+func tomlLocations(data []byte) map[string]location {
+	s := &tomlScanner{
+		data:      data,
+		locations: make(map[string]location),
+		arrays:    make(map[string]int),
+	}
+	s.mark("")
+	table := ""
+	for {
+		s.skip(true)
+		if s.offset >= len(s.data) {
+			break
+		}
+		start := s.offset
+		switch {
+		case bytes.HasPrefix(s.data[s.offset:], []byte("[[")):
+			s.offset += 2
+			table = s.header(s.keys(), true, start)
+			s.offset += 2
+		case s.data[s.offset] == '[':
+			s.offset++
+			table = s.header(s.keys(), false, start)
+			s.offset++
+		default:
+			keys := s.keys()
+			s.offset++ // =
+			s.value(joinPath(table, strings.Join(keys, ".")))
+		}
+		if s.offset == start {
+			// not toml we understand, keep what we found
+			break
+		}
+	}
+	return s.locations
+}
+
+// header resolves the path of a table header, the latest table of the
+// arrays of tables on the way.
+func (s *tomlScanner) header(keys []string, array bool, start int) string {
+	path := ""
+	for i, key := range keys {
+		path = joinPath(path, key)
+		if array && i == len(keys)-1 {
+			n := s.arrays[path]
+			s.arrays[path] = n + 1
+			if n == 0 {
+				s.markAt(path, start)
+			}
+			path = indexPath(path, n)
+		} else if n, ok := s.arrays[path]; ok {
+			path = indexPath(path, n-1)
+		}
+	}
+	s.markAt(path, start)
+	return path
+}
+
+func (s *tomlScanner) mark(path string) {
+	s.markAt(path, s.offset)
+}
+
+func (s *tomlScanner) markAt(path string, offset int) {
+	if _, ok := s.locations[path]; ok {
+		return
+	}
+	line, column := position(s.data, int64(offset))
+	s.locations[path] = location{line, column}
+}
+
+// skip moves past blanks and comments, and newlines when lines is set.
+func (s *tomlScanner) skip(lines bool) {
+	for s.offset < len(s.data) {
+		switch c := s.data[s.offset]; {
+		case c == ' ' || c == '\t':
+			s.offset++
+		case lines && (c == '\n' || c == '\r'):
+			s.offset++
+		case c == '#':
+			for s.offset < len(s.data) && s.data[s.offset] != '\n' {
+				s.offset++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// keys reads a dotted key, stopping before what follows it.
+func (s *tomlScanner) keys() []string {
+	var keys []string
+	for s.offset < len(s.data) {
+		s.skip(false)
+		keys = append(keys, s.key())
+		s.skip(false)
+		if s.offset >= len(s.data) || s.data[s.offset] != '.' {
+			break
+		}
+		s.offset++
+	}
+	return keys
+}
+
+func (s *tomlScanner) key() string {
+	start := s.offset
+	if s.offset < len(s.data) && (s.data[s.offset] == '"' || s.data[s.offset] == '\'') {
+		s.quoted()
+		raw := string(s.data[start:s.offset])
+		if raw[0] == '\'' {
+			return raw[1 : len(raw)-1]
+		}
+		key, err := strconv.Unquote(raw)
+		if err != nil {
+			return raw[1 : len(raw)-1]
+		}
+		return key
+	}
+	for s.offset < len(s.data) && isBareKey(s.data[s.offset]) {
+		s.offset++
+	}
+	return string(s.data[start:s.offset])
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// quoted moves past a string, multi-line ones included.
+func (s *tomlScanner) quoted() {
+	quote := s.data[s.offset]
+	delim := []byte{quote}
+	if bytes.HasPrefix(s.data[s.offset:], []byte{quote, quote, quote}) {
+		delim = []byte{quote, quote, quote}
+	}
+	s.offset += len(delim)
+	for s.offset < len(s.data) {
+		if quote == '"' && s.data[s.offset] == '\\' {
+			s.offset += 2
+			continue
+		}
+		if bytes.HasPrefix(s.data[s.offset:], delim) {
+			s.offset += len(delim)
+			// a multi-line string may end in up to two more quotes
+			for len(delim) == 3 && s.offset < len(s.data) && s.data[s.offset] == quote {
+				s.offset++
+			}
+			return
+		}
+		s.offset++
+	}
+}
+
+// value reads the value at path, with the values in it.
+func (s *tomlScanner) value(path string) {
+	s.skip(false)
+	s.mark(path)
+	if s.offset >= len(s.data) {
+		return
+	}
+	switch s.data[s.offset] {
+	case '"', '\'':
+		s.quoted()
+	case '[':
+		s.offset++
+		for i := 0; s.offset < len(s.data); i++ {
+			s.skip(true)
+			if s.offset >= len(s.data) || s.data[s.offset] == ']' {
+				break
+			}
+			start := s.offset
+			s.value(indexPath(path, i))
+			s.skip(true)
+			if s.offset < len(s.data) && s.data[s.offset] == ',' {
+				s.offset++
+			} else if s.offset == start {
+				return
+			}
+		}
+		s.offset++
+	case '{':
+		s.offset++
+		for s.offset < len(s.data) {
+			s.skip(true)
+			if s.offset >= len(s.data) || s.data[s.offset] == '}' {
+				break
+			}
+			start := s.offset
+			keys := s.keys()
+			s.offset++ // =
+			s.value(joinPath(path, strings.Join(keys, ".")))
+			s.skip(true)
+			if s.offset < len(s.data) && s.data[s.offset] == ',' {
+				s.offset++
+			} else if s.offset == start {
+				return
+			}
+		}
+		s.offset++
+	default:
+		// numbers, bools and dates, which may hold a space
+		for s.offset < len(s.data) && strings.IndexByte(",]}#\r\n", s.data[s.offset]) < 0 {
+			s.offset++
+		}
+	}
+}
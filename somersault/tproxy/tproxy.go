@@ -0,0 +1,78 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+var (
+	NotSocket      = errors.New("input is not a socket")
+	NotTransparent = errors.New("connection was not intercepted")
+	NoMetadata     = errors.New("metadata not found")
+)
+
+// Config is the "tproxy" inbound, the first stage of a chain on a listener
+// with "transparent" set. TPROXY keeps the original destination as the
+// local address of tcp connections and udp sessions, it becomes the
+// destination the following stages dial.
+type Config struct {
+}
+
+func (c *Config) DeepCopy() pipeline.Config {
+	return &Config{}
+}
+
+func (c *Config) New(ctx context.Context, input, output pipeline.Pipeline) (pipeline.Pipeline, error) {
+	md := pipeline.GetMetadata(ctx)
+	if md == nil {
+		return nil, NoMetadata
+	}
+	conn, ok := input.(net.Conn)
+	if !ok {
+		return nil, NotSocket
+	}
+
+	var dst *pipeline.Address
+	var ip net.IP
+	switch addr := conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+		dst = &pipeline.Address{Network: "tcp", Host: addr.IP.String(), Port: addr.Port}
+	case *net.UDPAddr:
+		ip = addr.IP
+		dst = &pipeline.Address{Network: "udp", Host: addr.IP.String(), Port: addr.Port}
+	default:
+		return nil, NotSocket
+	}
+	if isListener(md.Listener, ip, dst.Port) {
+		return nil, NotTransparent
+	}
+	md.Destination = dst
+	return input, nil
+}
+
+// isListener reports whether the connection was made to the listener
+// itself, dialing it would loop back into the chain.
+func isListener(listener net.Addr, ip net.IP, port int) bool {
+	if listener == nil {
+		return false
+	}
+	host, p, err := net.SplitHostPort(listener.String())
+	if err != nil || p != strconv.Itoa(port) {
+		return false
+	}
+	lip := net.ParseIP(host)
+	if lip == nil || lip.IsUnspecified() {
+		return ip.IsLoopback()
+	}
+	return lip.Equal(ip)
+}
+
+func init() {
+	config := &Config{}
+	pipeline.RegistePipelineCreator("tproxy", config)
+}
@@ -0,0 +1,79 @@
+package tproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// conn is a connection TPROXY delivered to local, the original destination.
+type conn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c conn) LocalAddr() net.Addr { return c.local }
+
+func TestNew(t *testing.T) {
+	listener := &net.TCPAddr{IP: net.IPv4zero, Port: 12345}
+	pipe, _ := net.Pipe()
+	defer pipe.Close()
+	tests := []struct {
+		name  string
+		input pipeline.Pipeline
+		dst   *pipeline.Address
+		err   error
+	}{
+		{"tcp", conn{local: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}}, &pipeline.Address{Network: "tcp", Host: "10.0.0.1", Port: 80}, nil},
+		{"udp", conn{local: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}}, &pipeline.Address{Network: "udp", Host: "2001:db8::1", Port: 53}, nil},
+		{"other port", conn{local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}}, &pipeline.Address{Network: "tcp", Host: "127.0.0.1", Port: 80}, nil},
+		{"listener", conn{local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}}, nil, NotTransparent},
+		{"pipe", pipe, nil, NotSocket},
+	}
+	for _, tt := range tests {
+		md := &pipeline.Metadata{Listener: listener}
+		ctx := pipeline.WithMetadata(context.Background(), md)
+		_, err := (&Config{}).New(ctx, tt.input, nil)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.dst == nil && md.Destination != nil || tt.dst != nil && (md.Destination == nil || *md.Destination != *tt.dst) {
+			t.Errorf("%s: destination %v, want %v", tt.name, md.Destination, tt.dst)
+		}
+	}
+
+	_, err := (&Config{}).New(context.Background(), pipe, nil)
+	if err != NoMetadata {
+		t.Errorf("no metadata: error %v, want %v", err, NoMetadata)
+	}
+}
+
+func TestIsListener(t *testing.T) {
+	tests := []struct {
+		listener string
+		ip       string
+		port     int
+		want     bool
+	}{
+		{"0.0.0.0:1080", "127.0.0.1", 1080, true},
+		{"0.0.0.0:1080", "10.0.0.1", 1080, false},
+		{"[::]:1080", "::1", 1080, true},
+		{"10.0.0.1:1080", "10.0.0.1", 1080, true},
+		{"10.0.0.1:1080", "10.0.0.2", 1080, false},
+		{"10.0.0.1:1080", "10.0.0.1", 80, false},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.listener)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isListener(addr, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("isListener(%s, %s, %d) = %v, want %v", tt.listener, tt.ip, tt.port, got, tt.want)
+		}
+	}
+	if isListener(nil, net.ParseIP("127.0.0.1"), 1080) {
+		t.Error("connection to a nil listener")
+	}
+}
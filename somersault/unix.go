@@ -0,0 +1,128 @@
+package somersault
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+func isUnixNetwork(network string) bool {
+	return network == "unix" || network == "unixpacket"
+}
+
+// isAbstract reports a linux abstract socket, it has no file behind it.
+func isAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket cleans up the socket file a previous run left behind.
+// A socket something still listens on is left alone, like anything that is
+// not a socket, so listen fails loudly.
+func removeStaleSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !isRefused(err) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// setSocketPermission applies the "owner" and "group" options of a unix
+// listener entry to its socket file, the mode is set as it is created.
+func setSocketPermission(path string, l *Listener) error {
+	if isAbstract(path) {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if l.Owner != "" {
+		id, err := lookupID(l.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if l.Group != "" {
+		id, err := lookupID(l.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
+
+func (s *Somerasult) listenUnix(network, path string, l *Listener) (net.Listener, error) {
+	if !isAbstract(path) {
+		err := removeStaleSocket(network, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var listener net.Listener
+	listen := func() error {
+		var err error
+		listener, err = net.Listen(network, path)
+		return err
+	}
+	var err error
+	if l.Mode != "" && !isAbstract(path) {
+		m, perr := strconv.ParseUint(l.Mode, 8, 32)
+		if perr != nil {
+			return nil, fmt.Errorf("invalid mode %s", l.Mode)
+		}
+		err = withUmask(uint32(m), listen)
+	} else {
+		err = listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = setSocketPermission(path, l)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
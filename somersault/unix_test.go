@@ -0,0 +1,70 @@
+//go:build !windows
+
+package somersault
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := removeStaleSocket("unix", live); err == nil {
+		t.Error("removed the socket of a live listener")
+	}
+	if _, err := os.Lstat(live); err != nil {
+		t.Error(err)
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl.Close()
+	if err := removeStaleSocket("unix", stale); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale socket left: %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket("unix", file); err == nil {
+		t.Error("removed a regular file")
+	}
+
+	if err := removeStaleSocket("unix", filepath.Join(dir, "missing")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenUnixMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	s := &Somerasult{}
+	l, err := s.listenUnix("unix", path, &Listener{Address: path, Mode: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("mode %o, want 600", perm)
+	}
+}
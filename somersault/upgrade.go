@@ -0,0 +1,218 @@
+package somersault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A process upgrading itself runs its executable again and hands it the
+// listening sockets. The child finds them in the environment,
+//
+//	SOMERSAULT_LISTEN_FDS  {"<network> <address>": fd, ...}
+//	SOMERSAULT_READY_FD    fd to write to once it serves
+//
+// and the parent drains and exits when the child is ready.
+const (
+	listenFDsEnv   = "SOMERSAULT_LISTEN_FDS"
+	readyFDEnv     = "SOMERSAULT_READY_FD"
+	upgradeTimeout = 30 * time.Second
+)
+
+var (
+	inheritOnce sync.Once
+	inheritLock sync.Mutex
+	inherited   map[string]*os.File
+
+	NotHandedOver = errors.New("listener can not be handed over")
+)
+
+// loadInherited reads the sockets handed over by the parent, they are
+// hidden from the processes we start in turn.
+func loadInherited() {
+	inheritOnce.Do(func() {
+		inherited = make(map[string]*os.File)
+		manifest := os.Getenv(listenFDsEnv)
+		os.Unsetenv(listenFDsEnv)
+		if manifest == "" {
+			return
+		}
+		var fds map[string]int
+		if err := json.Unmarshal([]byte(manifest), &fds); err != nil {
+			return
+		}
+		for key, fd := range fds {
+			inherited[key] = os.NewFile(uintptr(fd), key)
+		}
+	})
+}
+
+func takeInherited(key string) *os.File {
+	loadInherited()
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+	f := inherited[key]
+	delete(inherited, key)
+	return f
+}
+
+// closeInherited closes the sockets, from the parent or systemd, the
+// config does not listen on.
+func closeInherited() {
+	loadInherited()
+	loadActivated()
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+	for key, f := range inherited {
+		f.Close()
+		delete(inherited, key)
+	}
+	for name, files := range activated {
+		for _, f := range files {
+			f.Close()
+		}
+		delete(activated, name)
+	}
+}
+
+// notifyParent tells the upgrading parent we are serving.
+func notifyParent() {
+	v := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// inherit returns the listener of e handed over by the parent or opened
+// by systemd, nil when there is none.
+func (s *Somerasult) inherit(e *entry) (net.Listener, error) {
+	f := takeInherited(e.key)
+	if f == nil && e.listener.Name != "" {
+		f = takeActivated(e.listener.Name)
+	}
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	s.logger.Printf("inherit listener %s from %s\n", e.addr, f.Name())
+	switch e.network {
+	case "udp", "udp4", "udp6":
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, err
+		}
+		udp, ok := conn.(*net.UDPConn)
+		if !ok {
+			conn.Close()
+			return nil, fmt.Errorf("inherited %s is not udp", e.key)
+		}
+		return newPacketListener(udp, e.listener.Transparent, s.logger), nil
+	}
+	return net.FileListener(f)
+}
+
+// listenerFile returns a duplicate of the socket of l.
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// the child keeps using the path
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	case *packetListener:
+		return l.conn.File()
+	}
+	return nil, NotHandedOver
+}
+
+// Upgrade starts the executable again with the listeners of s and waits
+// until it serves. The caller then closes s to drain its connections.
+// Listeners that are not sockets, like reverse agents, are opened anew by
+// the child.
+func (s *Somerasult) Upgrade() error {
+	s.lock.Lock()
+	services := s.services
+	admin, adminAddress := s.adminListener, s.adminAddress
+	s.lock.Unlock()
+
+	fds := make(map[string]int)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(key string, l net.Listener) {
+		f, err := listenerFile(l)
+		if err != nil {
+			s.logger.Printf("upgrade %s: %s\n", key, err)
+			return
+		}
+		// the child sees ExtraFiles from fd 3 on
+		fds[key] = 3 + len(files)
+		files = append(files, f)
+	}
+	for _, srv := range services {
+		add(srv.key, srv.Listener)
+	}
+	if admin != nil {
+		add(adminKey(adminAddress), admin)
+	}
+	manifest, err := json.Marshal(fds)
+	if err != nil {
+		return err
+	}
+
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	readyFD := 3 + len(files)
+	files = append(files, w)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+string(manifest),
+		readyFDEnv+"="+strconv.Itoa(readyFD),
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	// only the child may hold the write end, so a child dying early
+	// reads as EOF
+	w.Close()
+	files = files[:len(files)-1]
+
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	_, err = io.ReadFull(ready, make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process did not start: %s", err)
+	}
+	s.logger.Printf("new process %d serves\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
@@ -0,0 +1,219 @@
+package somersault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gchange/somersault/somersault/pipeline"
+)
+
+// A listener may be written as a URI, its scheme naming the stages of its
+// pipeline like an outbound, see pipeline.URI,
+//
+//	socks5://alice:secret@:1080
+//	http://127.0.0.1:8080?max_connections=100
+//
+// The host and port are listened on, all addresses without a host. The
+// user and password are the user the first stage with users accepts.
+// Query keys naming a listener option set it, the others go to the
+// stages.
+const anyAddress = "0.0.0.0"
+
+// listenerObject expands the listener URI s into its json object.
+func listenerObject(s string) (map[string]interface{}, error) {
+	u, err := pipeline.ParseURI(s)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if host == "" {
+		host = anyAddress
+	}
+	m := map[string]interface{}{"address": host}
+	if u.Port != "" {
+		m["port"] = u.Port
+	}
+
+	options := make(map[string]interface{})
+	if u.User != nil {
+		password, _ := u.User.Password()
+		options["users"] = map[string]interface{}{u.User.Username(): password}
+	}
+	fields := make(map[string]pipeline.FieldInfo)
+	for _, f := range pipeline.Describe(&Listener{}) {
+		fields[f.Key] = f
+	}
+	for key, v := range u.QueryOptions() {
+		f, ok := fields[key]
+		if !ok {
+			options[key] = v
+			continue
+		}
+		switch key {
+		case "address", "port", "pipeline":
+			return nil, fmt.Errorf("%s can not be in the query", key)
+		}
+		if _, ok := v.([]interface{}); !ok && strings.HasPrefix(f.Type, "list of ") {
+			v = []interface{}{v}
+		}
+		m[key] = v
+	}
+	stages, err := u.Stages(options)
+	if err != nil {
+		return nil, err
+	}
+	m["pipeline"] = stages
+	return m, nil
+}
+
+// URI writes l as a URI parsing back into the same listener, NotURI when
+// there is none, like for a listener with options of its network.
+func (l *Listener) URI() (string, error) {
+	network, _ := l.socket()
+	if len(l.Options) != 0 || isUnixNetwork(network) || len(l.Pipeline) == 0 {
+		return "", pipeline.NotURI
+	}
+
+	var protocols []string
+	options := make(map[string]interface{})
+	for _, p := range l.Pipeline {
+		stages := []interface{}{p}
+		if s, ok := p.(string); ok {
+			var err error
+			stages, err = pipeline.ExpandURI(s)
+			if err != nil {
+				return "", err
+			}
+		}
+		for _, stage := range stages {
+			protocol, config, err := pipeline.StageOptions(stage)
+			if err != nil {
+				return "", err
+			}
+			protocols = append(protocols, protocol)
+			for key, v := range config {
+				if _, ok := options[key]; ok {
+					return "", pipeline.NotURI
+				}
+				options[key] = v
+			}
+		}
+	}
+	user := ""
+	if users, ok := options["users"].(map[string]interface{}); ok && len(users) == 1 {
+		for name, v := range users {
+			if password, ok := v.(string); ok {
+				user = url.UserPassword(name, password).String() + "@"
+				delete(options, "users")
+			}
+		}
+	}
+
+	// the listener options set, but for the socket
+	plain := *l
+	plain.Pipeline = nil
+	buf, err := json.Marshal(&plain)
+	if err != nil {
+		return "", err
+	}
+	var listenerOptions map[string]interface{}
+	err = json.Unmarshal(buf, &listenerOptions)
+	if err != nil {
+		return "", err
+	}
+	delete(listenerOptions, "address")
+	delete(listenerOptions, "port")
+	delete(listenerOptions, "pipeline")
+	if listenerOptions["network"] == "tcp" {
+		delete(listenerOptions, "network")
+	}
+	for key, v := range listenerOptions {
+		if _, ok := options[key]; ok {
+			return "", pipeline.NotURI
+		}
+		options[key] = v
+	}
+	query, err := pipeline.EncodeQuery(options)
+	if err != nil {
+		return "", err
+	}
+
+	host := l.Address
+	if host == anyAddress {
+		host = ""
+	}
+	s := strings.Join(protocols, "+") + "://" + user + net.JoinHostPort(host, fmt.Sprint(l.Port))
+	if query != "" {
+		s += "?" + query
+	}
+
+	// only a uri giving back the same listener will do
+	m, err := listenerObject(s)
+	if err != nil {
+		return "", pipeline.NotURI
+	}
+	buf, err = json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	back := &Listener{}
+	if back.UnmarshalJSON(buf) != nil || !pipeline.SameChain(l.Pipeline, back.Pipeline) {
+		return "", pipeline.NotURI
+	}
+	back.Pipeline = nil
+	// tcp is the network when none is given
+	plain.Network = network
+	back.Network, _ = back.socket()
+	a, _ := json.Marshal(&plain)
+	b, _ := json.Marshal(back)
+	if string(a) != string(b) {
+		return "", pipeline.NotURI
+	}
+	return s, nil
+}
+
+// Shorthand is c for printing, with the listeners and stages having a URI
+// written as one.
+func (c *Config) Shorthand() (map[string]interface{}, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return nil, err
+	}
+	shortChain := func(chain interface{}, stages []interface{}) {
+		list, _ := chain.([]interface{})
+		for i, stage := range stages {
+			if s, err := pipeline.StageURI(stage); err == nil && i < len(list) {
+				list[i] = s
+			}
+		}
+	}
+	listeners, _ := m["config"].([]interface{})
+	for i, l := range c.Config {
+		if l == nil || i >= len(listeners) {
+			continue
+		}
+		if s, err := l.URI(); err == nil {
+			listeners[i] = s
+		} else if object, ok := listeners[i].(map[string]interface{}); ok {
+			shortChain(object["pipeline"], l.Pipeline)
+		}
+	}
+	forwards, _ := m["forward"].([]interface{})
+	for i, f := range c.Forward {
+		if i >= len(forwards) {
+			break
+		}
+		if object, ok := forwards[i].(map[string]interface{}); ok {
+			shortChain(object["via"], f.Via)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,145 @@
+package somersault
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	_ "github.com/gchange/somersault/somersault/direct"
+	_ "github.com/gchange/somersault/somersault/forward"
+	_ "github.com/gchange/somersault/somersault/httpproxy"
+	"github.com/gchange/somersault/somersault/pipeline"
+	_ "github.com/gchange/somersault/somersault/socks5"
+)
+
+func TestListenerURI(t *testing.T) {
+	// each parses into a listener written back as the same uri
+	uris := []string{
+		"socks5://alice:s3cret@:1080",
+		"socks5://127.0.0.1:1080?allow=10.0.0.0%2F8&allow=192.0.2.0%2F24",
+		"http://127.0.0.1:8080?max_connections=100",
+		"http://[::1]:8080?proxy_protocol=true&proxy_trusted=10.0.0.1",
+	}
+	for _, uri := range uris {
+		l := &Listener{}
+		buf, _ := json.Marshal(uri)
+		if err := l.UnmarshalJSON(buf); err != nil {
+			t.Errorf("%s: %v", uri, err)
+			continue
+		}
+		if s, err := l.URI(); err != nil || s != uri {
+			t.Errorf("%s written back as %s %v", uri, s, err)
+		}
+	}
+
+	// listeners with no uri form
+	objects := []string{
+		`{"network": "unix", "address": "/run/s.sock", "pipeline": ["echo"]}`,
+		`{"address": "127.0.0.1", "port": 1080, "pipeline": [{"protocol": "socks5", "config": {"users": {"a": "1", "b": "2"}}}]}`,
+		`{"address": "127.0.0.1", "port": 1080, "pipeline": [{"protocol": "socks5", "config": {"port": 1}}, {"protocol": "tcp", "config": {"port": 2}}]}`,
+	}
+	for _, object := range objects {
+		l := &Listener{}
+		if err := l.UnmarshalJSON([]byte(object)); err != nil {
+			t.Errorf("%s: %v", object, err)
+			continue
+		}
+		if s, err := l.URI(); !errors.Is(err, pipeline.NotURI) {
+			t.Errorf("%s written as %s %v", object, s, err)
+		}
+	}
+}
+
+func TestListenerObject(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+		err  string
+	}{
+		{
+			uri:  "socks5://alice:pw@:1080",
+			want: `{"address": "0.0.0.0", "port": "1080", "pipeline": [{"protocol": "socks5", "config": {"users": {"alice": "pw"}}}]}`,
+		},
+		{
+			uri:  "http://127.0.0.1:8080?allow=10.0.0.0/8&network=tcp4",
+			want: `{"address": "127.0.0.1", "port": "8080", "allow": ["10.0.0.0/8"], "network": "tcp4", "pipeline": [{"protocol": "http", "config": {}}]}`,
+		},
+		{uri: "http://:8080?pipeline=echo", err: "pipeline can not be in the query"},
+		{uri: "http://:8080?port=1", err: "port can not be in the query"},
+		{uri: "http://:8080?nope=1", err: "http takes no nope"},
+	}
+	for _, tt := range tests {
+		m, err := listenerObject(tt.uri)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.uri, err, tt.err)
+			}
+			continue
+		}
+		var want map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := json.Marshal(m)
+		var back map[string]interface{}
+		json.Unmarshal(got, &back)
+		if err != nil || !reflect.DeepEqual(back, want) {
+			t.Errorf("%s:\n%s %v\nwant\n%s", tt.uri, got, err, tt.want)
+		}
+	}
+}
+
+func TestShorthand(t *testing.T) {
+	c, err := ParseConfig([]byte(`{
+		"config": [
+			{"address": "0.0.0.0", "port": 1080, "pipeline": [{"protocol": "socks5", "config": {"users": {"alice": "pw"}}}]},
+			"http://127.0.0.1:8080",
+			{"network": "unix", "address": "/run/s.sock", "idle_timeout": "1m30s", "buffer_size": "64KiB", "pipeline": [{"protocol": "socks5"}, {"protocol": "tcp", "config": {"address": "10.0.0.2", "port": 22}}]}
+		],
+		"forward": [
+			{"listen": "127.0.0.1:2222", "target": "10.0.0.3:22", "via": [{"protocol": "socks5", "config": {"address": "10.0.0.2", "port": 1080, "username": "bob", "password": "pw"}}]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Shorthand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := m["config"].([]interface{})
+	want := []interface{}{"socks5://alice:pw@:1080", "http://127.0.0.1:8080"}
+	if !reflect.DeepEqual(listeners[:2], want) {
+		t.Errorf("listeners %v, want %v", listeners[:2], want)
+	}
+	unix, _ := listeners[2].(map[string]interface{})
+	chain := []interface{}{"socks5://", "tcp://10.0.0.2:22"}
+	if unix == nil || !reflect.DeepEqual(unix["pipeline"], chain) {
+		t.Errorf("unix listener %v, want the chain %v", listeners[2], chain)
+	}
+	forward := m["forward"].([]interface{})[0].(map[string]interface{})
+	via := []interface{}{"socks5://bob:pw@10.0.0.2:1080"}
+	if !reflect.DeepEqual(forward["via"], via) {
+		t.Errorf("via %v, want %v", forward["via"], via)
+	}
+
+	// the shorthand is the same config
+	buf, _ := json.Marshal(m)
+	back, err := ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range c.Config {
+		if !pipeline.SameChain(c.Config[i].Pipeline, back.Config[i].Pipeline) {
+			t.Errorf("config[%d] pipeline %v, was %v", i, back.Config[i].Pipeline, c.Config[i].Pipeline)
+		}
+	}
+	if back.Config[2].IdleTimeout != c.Config[2].IdleTimeout || back.Config[2].BufferSize != c.Config[2].BufferSize {
+		t.Errorf("unix listener timeout %v and buffer %d, was %v and %d", back.Config[2].IdleTimeout,
+			back.Config[2].BufferSize, c.Config[2].IdleTimeout, c.Config[2].BufferSize)
+	}
+	if !pipeline.SameChain(c.Forward[0].Via, back.Forward[0].Via) {
+		t.Errorf("forward via %v, was %v", back.Forward[0].Via, c.Forward[0].Via)
+	}
+}